@@ -2,6 +2,7 @@ package instagram
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -11,16 +12,20 @@ import (
 	"image/jpeg"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	instagramURL      = "https://api.instagram.com/v1%s"
-	instagramClientID = "6b2ea4cc0093441fb38990045a855e2a"
-	instagramSecuret  = "ea785b48dd014eaeb4fd97c0a23d6ae5"
+	// DefaultBaseURL is the root of the Instagram API.
+	DefaultBaseURL = "https://api.instagram.com/v1"
 )
 
 const (
@@ -28,30 +33,80 @@ const (
 	ThumbnailSize = 150
 )
 
+// HTTPClient is used for all requests. Its timeout bounds each request,
+// including reading the body.
+var HTTPClient = &http.Client{Timeout: 30 * time.Second}
+
 // Client is what talks to the Instagram API.
 type Client interface {
 	// Popular calls the Instagram Popular API and returns the data.
-	Popular() (*MediaList, error)
+	Popular(ctx context.Context) (*MediaList, error)
 
 	// Search calls the Instagram Search API and returns the data.
-	Search(lat, lng string) (*MediaList, error)
+	Search(ctx context.Context, q LocationQuery) (*MediaList, error)
 
 	// Tagged calls the Instagram Tagged API and returns the data.
-	Tagged(tag, maxTagID string) (*MediaList, error)
+	Tagged(ctx context.Context, tag, maxTagID string) (*MediaList, error)
 }
 
 // Client makes requests to Instagram.
 type apiClient struct {
 	BaseURL string
 	URLSigner
+	HTTP  *http.Client
+	Retry RetryPolicy
+	rate  *rateLimit
+}
+
+// ClientOptions configure a Client. Zero values use the defaults.
+type ClientOptions struct {
+	// BaseURL is the root of the API, such as a mock server. Defaults to
+	// DefaultBaseURL.
+	BaseURL string
+	// HTTPClient makes the API requests. Defaults to HTTPClient.
+	HTTPClient *http.Client
+	// Signer adds credentials to each request. Defaults to the signer for
+	// Credentials.
+	Signer URLSigner
+	// Credentials are used when Signer isn't set. Defaults to
+	// DefaultCredentials.
+	Credentials Credentials
+	// Retry decides how failed requests are retried. Defaults to
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
 }
 
-// NewClient creates an initialized Client.
+// NewClient creates an initialized Client with the default options.
 func NewClient() Client {
-	return &apiClient{
-		BaseURL:   instagramURL,
-		URLSigner: clientSecretSigner{instagramClientID, instagramSecuret},
+	return NewClientWithOptions(ClientOptions{})
+}
+
+// NewClientWithOptions creates an initialized Client.
+func NewClientWithOptions(opts ClientOptions) Client {
+	c := &apiClient{
+		BaseURL:   opts.BaseURL,
+		URLSigner: opts.Signer,
+		HTTP:      opts.HTTPClient,
+		Retry:     opts.Retry,
+		rate:      &rateLimit{},
+	}
+	if c.BaseURL == "" {
+		c.BaseURL = DefaultBaseURL
+	}
+	if c.URLSigner == nil {
+		creds := opts.Credentials
+		if creds == (Credentials{}) {
+			creds = DefaultCredentials
+		}
+		c.URLSigner = creds.Signer()
+	}
+	if c.HTTP == nil {
+		c.HTTP = HTTPClient
 	}
+	if c.Retry == (RetryPolicy{}) {
+		c.Retry = DefaultRetryPolicy
+	}
+	return c
 }
 
 // MediaList is a result set containing media.
@@ -69,9 +124,28 @@ type Pagination struct {
 // Media is either a photo or video. If it's a video, it has both Images and
 // Videos representations. If it's a photo, it only has Images representations.
 type Media struct {
-	Type   string          `json:"type"`
-	Images map[string]*Rep `json:"images"`
-	Videos map[string]*Rep `json:"videos"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	CreatedTime string          `json:"created_time"`
+	Link        string          `json:"link"`
+	User        User            `json:"user"`
+	Caption     *Caption        `json:"caption"`
+	Tags        []string        `json:"tags"`
+	Images      map[string]*Rep `json:"images"`
+	Videos      map[string]*Rep `json:"videos"`
+}
+
+// User is the person who posted media.
+type User struct {
+	ID             string `json:"id"`
+	Username       string `json:"username"`
+	FullName       string `json:"full_name"`
+	ProfilePicture string `json:"profile_picture"`
+}
+
+// Caption is the text posted with media.
+type Caption struct {
+	Text string `json:"text"`
 }
 
 // IsPhoto tells you if this is a photo. If it's not, it's a video.
@@ -79,6 +153,29 @@ func (m Media) IsPhoto() bool {
 	return m.Type == "image"
 }
 
+// Created returns the time the media was posted, or the zero time if it's
+// unknown.
+func (m Media) Created() time.Time {
+	secs, err := strconv.ParseInt(m.CreatedTime, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// LocationQuery describes media posted near a location.
+type LocationQuery struct {
+	Lat string
+	Lng string
+	// Distance is the search radius in meters. Instagram uses 1000 if it's
+	// zero, and allows up to 5000.
+	Distance int
+	// MinTime and MaxTime limit results to media posted within a time
+	// window. Zero values are unbounded.
+	MinTime time.Time
+	MaxTime time.Time
+}
+
 // StandardImage returns the standard resolution image representation.
 func (m Media) StandardImage() *Rep {
 	return m.Images["standard_resolution"]
@@ -98,6 +195,8 @@ type Rep struct {
 	fetched bool
 	body    io.ReadCloser
 	code    int
+	// client fetches the JPG data. Defaults to HTTPClient.
+	client *http.Client
 }
 
 type nopCloser struct {
@@ -126,18 +225,39 @@ func NewFakeRepWithImage(url string, imageData io.Reader) *Rep {
 	}
 }
 
+// Open requests the JPG data. The request is cancelled if ctx is done before
+// the data is read. Read calls Open with a background context if it hasn't
+// been called.
+func (r *Rep) Open(ctx context.Context) error {
+	if r.fetched {
+		return nil
+	}
+	r.fetched = true
+	req, err := http.NewRequest("GET", r.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := r.client
+	if client == nil {
+		client = HTTPClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	r.code = res.StatusCode
+	if r.code == http.StatusOK {
+		r.body = res.Body
+	} else {
+		res.Body.Close()
+	}
+	return nil
+}
+
 // Read implements io.Reader to fetch the JPG data.
 func (r *Rep) Read(p []byte) (int, error) {
-	if !r.fetched {
-		r.fetched = true
-		res, err := http.Get(r.URL)
-		if err != nil {
-			return 0, err
-		}
-		r.code = res.StatusCode
-		if r.code == http.StatusOK {
-			r.body = res.Body
-		}
+	if err := r.Open(context.Background()); err != nil {
+		return 0, err
 	}
 	if r.body != nil {
 		return r.body.Read(p)
@@ -145,8 +265,20 @@ func (r *Rep) Read(p []byte) (int, error) {
 	return 0, fmt.Errorf("failed to fetch data, response was code %d", r.code)
 }
 
+// Close releases the JPG data.
+func (r *Rep) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
 // Image returns an image object from the JPG.
-func (r *Rep) Image() (image.Image, error) {
+func (r *Rep) Image(ctx context.Context) (image.Image, error) {
+	if err := r.Open(ctx); err != nil {
+		return nil, err
+	}
+	defer r.Close()
 	var buf bytes.Buffer
 	if c, err := buf.ReadFrom(r); err != nil || c == 0 {
 		return nil, err
@@ -154,67 +286,240 @@ func (r *Rep) Image() (image.Image, error) {
 	return jpeg.Decode(&buf)
 }
 
-func (c apiClient) Popular() (*MediaList, error) {
-	var m MediaList
+func (c apiClient) Popular(ctx context.Context) (*MediaList, error) {
 	params := map[string]string{
 		"count": "100",
 	}
-	url := c.formatURL("/media/popular", params)
-	err := c.getJSON(url, &m)
-	return &m, err
+	url, err := c.formatURL("/media/popular", params)
+	if err != nil {
+		return nil, err
+	}
+	return c.getMedia(ctx, url)
 }
 
-func (c apiClient) Search(lat, lng string) (*MediaList, error) {
-	var m MediaList
+func (c apiClient) Search(ctx context.Context, q LocationQuery) (*MediaList, error) {
 	params := map[string]string{
-		"lat":   lat,
-		"lng":   lng,
+		"lat":   q.Lat,
+		"lng":   q.Lng,
 		"count": "100",
 	}
-	url := c.formatURL("/media/search", params)
-	err := c.getJSON(url, &m)
-	return &m, err
+	if q.Distance > 0 {
+		params["distance"] = strconv.Itoa(q.Distance)
+	}
+	if !q.MinTime.IsZero() {
+		params["min_timestamp"] = strconv.FormatInt(q.MinTime.Unix(), 10)
+	}
+	if !q.MaxTime.IsZero() {
+		params["max_timestamp"] = strconv.FormatInt(q.MaxTime.Unix(), 10)
+	}
+	url, err := c.formatURL("/media/search", params)
+	if err != nil {
+		return nil, err
+	}
+	return c.getMedia(ctx, url)
 }
 
-func (c apiClient) Tagged(tag, maxTagID string) (*MediaList, error) {
-	var m MediaList
+func (c apiClient) Tagged(ctx context.Context, tag, maxTagID string) (*MediaList, error) {
 	params := map[string]string{
 		"count":      "100",
 		"max_tag_id": maxTagID,
 	}
 	endpoint := fmt.Sprintf("/tags/%s/media/recent", tag)
-	url := c.formatURL(endpoint, params)
-	err := c.getJSON(url, &m)
+	url, err := c.formatURL(endpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	return c.getMedia(ctx, url)
+}
+
+// getMedia calls a URL that lists media. The media's reps are fetched with
+// the client's HTTP client.
+func (c apiClient) getMedia(ctx context.Context, url string) (*MediaList, error) {
+	var m MediaList
+	err := c.getJSON(ctx, url, &m)
+	for _, media := range m.Media {
+		for _, r := range media.Images {
+			r.client = c.HTTP
+		}
+		for _, r := range media.Videos {
+			r.client = c.HTTP
+		}
+	}
 	return &m, err
 }
 
 // getJSON calls a URL and marshals the resulting JSON into the data struct. If
-// the response is anything but 200 an error is returned.
-func (c apiClient) getJSON(url string, data interface{}) error {
-	res, err := http.Get(url)
+// the response is anything but 200 a typed error is returned. Rate limits,
+// server errors and network errors are retried with backoff. A rate limit
+// that needs a longer wait than the retry policy's MaxDelay is returned as a
+// RateLimitedError instead.
+func (c apiClient) getJSON(ctx context.Context, url string, data interface{}) error {
+	for attempt := 0; ; attempt++ {
+		if err := c.rate.wait(ctx, url, c.Retry.MaxDelay); err != nil {
+			return err
+		}
+		err := c.tryGetJSON(ctx, url, data)
+		if err == nil || !retryable(ctx, err) || attempt >= c.Retry.MaxRetries {
+			return err
+		}
+		delay := c.Retry.backoff(attempt)
+		if e, ok := err.(*RateLimitedError); ok && e.RetryAfter > delay {
+			if e.RetryAfter > c.Retry.MaxDelay {
+				return err
+			}
+			delay = e.RetryAfter
+		}
+		log.Printf("Retrying in %s: %s\n", delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// tryGetJSON makes one attempt at getJSON.
+func (c apiClient) tryGetJSON(ctx context.Context, url string, data interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("Call to %s failed, status %d", url, res.StatusCode)
+	res, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
 	}
+	defer res.Body.Close()
+	c.rate.update(res, time.Now())
 	// TODO use streaming unmarshal
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return err
 	}
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return err
+	if res.StatusCode != http.StatusOK {
+		return responseError(url, res, body)
 	}
-	return nil
+	return json.Unmarshal(body, &data)
+}
+
+// retryable returns true if a request that failed with err may succeed if
+// it's tried again.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *RateLimitedError:
+		return true
+	case *StatusError:
+		return e.StatusCode >= 500
+	case *url.Error:
+		// Network errors.
+		return true
+	}
+	return false
+}
+
+// RetryPolicy describes how failed requests are retried.
+type RetryPolicy struct {
+	// MaxRetries is how many times to retry after the first attempt.
+	MaxRetries int
+	// BaseDelay is the delay before the first retry. It doubles for each
+	// subsequent retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries. A rate limit that needs a
+	// longer wait isn't waited for.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by NewClient.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 4,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   30 * time.Second,
+}
+
+// backoff returns the delay before retry number attempt, with jitter so that
+// clients don't retry in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimit tracks the rate limit headers in responses, holding requests
+// back once the limit is exhausted.
+type rateLimit struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// update reads rate limit headers. If no requests remain, requests wait until
+// the limit resets.
+func (r *rateLimit) update(res *http.Response, now time.Time) {
+	if r == nil {
+		return
+	}
+	var until time.Time
+	if res.StatusCode == http.StatusTooManyRequests {
+		if d := retryAfter(res, now); d > 0 {
+			until = now.Add(d)
+		}
+	}
+	if res.Header.Get("X-Ratelimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(res.Header.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+			until = time.Unix(reset, 0)
+		}
+	}
+	if until.IsZero() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until.After(r.until) {
+		r.until = until
+	}
+}
+
+// wait blocks until the rate limit has reset, or ctx is done. If that's
+// longer than max, it returns a RateLimitedError for url instead.
+func (r *rateLimit) wait(ctx context.Context, url string, max time.Duration) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	d := time.Until(r.until)
+	r.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	if d > max {
+		return &RateLimitedError{url, d}
+	}
+	log.Printf("Rate limited, waiting %s\n", d)
+	return sleep(ctx, d)
 }
 
 // formatURL combines query parameters to an endpoint, then signs the URL.
-func (c apiClient) formatURL(endpoint string, params map[string]string) string {
-	u, err := url.Parse(fmt.Sprintf(c.BaseURL, endpoint))
+func (c apiClient) formatURL(endpoint string, params map[string]string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + endpoint)
 	if err != nil {
-		panic("failed to parse instagram base url")
+		return "", fmt.Errorf("invalid instagram base url: %s", err)
 	}
 	// Add custom params to the query string.
 	q := u.Query()
@@ -227,7 +532,7 @@ func (c apiClient) formatURL(endpoint string, params map[string]string) string {
 
 	// Set new query string and stringify.
 	u.RawQuery = q.Encode()
-	return u.String()
+	return u.String(), nil
 }
 
 // URLSigner is the interface for things that modify a query string for
@@ -237,16 +542,46 @@ type URLSigner interface {
 }
 
 // clientSecretSigner implements URLSigner, it adds the client_id and sig
-// params to a query string.
+// params to a query string. The sig is left out if there's no secret.
 type clientSecretSigner struct {
 	ClientID string
 	Secret   string
 }
 
+// NewClientIDSigner gives you a URLSigner that identifies requests by client
+// id. If secret isn't empty, requests are also signed with it.
+func NewClientIDSigner(clientID, secret string) URLSigner {
+	return clientSecretSigner{clientID, secret}
+}
+
 // Sign implements URLSigner.
 func (s clientSecretSigner) Sign(endpoint string, q *url.Values) {
 	q.Set("client_id", s.ClientID)
-	q.Set("sig", sig(s.Secret, endpoint, *q))
+	if s.Secret != "" {
+		q.Set("sig", sig(s.Secret, endpoint, *q))
+	}
+}
+
+// accessTokenSigner implements URLSigner, it adds the access_token and sig
+// params to a query string. The sig is left out if there's no secret.
+type accessTokenSigner struct {
+	Token  string
+	Secret string
+}
+
+// NewAccessTokenSigner gives you a URLSigner that authenticates requests with
+// an OAuth access token. If secret isn't empty, requests are also signed with
+// it, as required when the client enforces signed requests.
+func NewAccessTokenSigner(token, secret string) URLSigner {
+	return accessTokenSigner{token, secret}
+}
+
+// Sign implements URLSigner.
+func (s accessTokenSigner) Sign(endpoint string, q *url.Values) {
+	q.Set("access_token", s.Token)
+	if s.Secret != "" {
+		q.Set("sig", sig(s.Secret, endpoint, *q))
+	}
 }
 
 // sig calculates the signature for an Instagram URL.
@@ -2,7 +2,15 @@ package instagram
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func Test_sig(t *testing.T) {
@@ -25,7 +33,7 @@ func Test_Client_Popular(t *testing.T) {
 		t.Skip("short mode: skipping live API calls")
 	}
 	c := NewClient()
-	p, err := c.Popular()
+	p, err := c.Popular(context.Background())
 	if err != nil {
 		t.Fatalf("Popular() failed: %s", err)
 	}
@@ -47,3 +55,188 @@ func Test_Client_Popular(t *testing.T) {
 		t.Fatalf("Rep#Read() got 0 bytes, want some bytes")
 	}
 }
+
+// newTestClient returns a client for a test server, with fast retries.
+func newTestClient(ts *httptest.Server) *apiClient {
+	return &apiClient{
+		BaseURL:   ts.URL,
+		URLSigner: clientSecretSigner{"id", "secret"},
+		HTTP:      ts.Client(),
+		Retry:     RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		rate:      &rateLimit{},
+	}
+}
+
+func Test_apiClient_retry(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, `{"data":[{"type":"image"}]}`)
+		}
+	}))
+	defer ts.Close()
+
+	list, err := newTestClient(ts).Tagged(context.Background(), "cat", "")
+	if err != nil {
+		t.Fatalf("Tagged got error %s", err)
+	}
+	if got, want := len(list.Media), 1; got != want {
+		t.Errorf("got %d media, want %d", got, want)
+	}
+	if got, want := calls, 3; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+}
+
+func Test_apiClient_longRateLimit(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	// Neither the response nor the next request waits for an hour.
+	c := newTestClient(ts)
+	for i := 0; i < 2; i++ {
+		_, err := c.Tagged(context.Background(), "cat", "")
+		if e, ok := err.(*RateLimitedError); !ok || e.RetryAfter < 59*time.Minute {
+			t.Errorf("Tagged got error %v, want RateLimitedError after an hour", err)
+		}
+	}
+	if got, want := calls, 1; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+}
+
+func Test_apiClient_Search(t *testing.T) {
+	var query url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"data":[{"type":"image","created_time":"1430000000"}]}`)
+	}))
+	defer ts.Close()
+
+	q := LocationQuery{
+		Lat:      "37.7",
+		Lng:      "-122.4",
+		Distance: 500,
+		MaxTime:  time.Unix(1430000100, 0),
+	}
+	list, err := newTestClient(ts).Search(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Search got error %s", err)
+	}
+	if got, want := list.Media[0].Created(), time.Unix(1430000000, 0); !got.Equal(want) {
+		t.Errorf("Created got %s, want %s", got, want)
+	}
+	for k, want := range map[string]string{
+		"lat":           "37.7",
+		"lng":           "-122.4",
+		"distance":      "500",
+		"max_timestamp": "1430000100",
+		"min_timestamp": "",
+	} {
+		if got := query.Get(k); got != want {
+			t.Errorf("%s got %q, want %q", k, got, want)
+		}
+	}
+}
+
+func Test_apiClient_repClient(t *testing.T) {
+	// Only the test server's client trusts its certificate.
+	var ts *httptest.Server
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/thumb.jpg" {
+			jpeg.Encode(w, image.NewRGBA(image.Rect(0, 0, 10, 10)), nil)
+			return
+		}
+		fmt.Fprintf(w, `{"data":[{"type":"image","images":{"thumbnail":{"url":"%s/thumb.jpg"}}}]}`, ts.URL)
+	}))
+	defer ts.Close()
+
+	list, err := newTestClient(ts).Tagged(context.Background(), "cat", "")
+	if err != nil {
+		t.Fatalf("Tagged got error %s", err)
+	}
+	m, err := list.Media[0].ThumbnailImage().Image(context.Background())
+	if err != nil {
+		t.Fatalf("Image got error %s", err)
+	}
+	if got, want := m.Bounds().Dx(), 10; got != want {
+		t.Errorf("got width %d, want %d", got, want)
+	}
+}
+
+func Test_apiClient_errors(t *testing.T) {
+	tests := []struct {
+		code  int
+		body  string
+		check func(error) bool
+		calls int
+	}{
+		{http.StatusTooManyRequests, "", IsRateLimited, 3},
+		{http.StatusNotFound, "", IsNotFound, 1},
+		{http.StatusUnauthorized, "", IsUnauthorized, 1},
+		{http.StatusBadRequest, `{"meta":{"error_type":"OAuthAccessTokenException","code":400}}`, IsUnauthorized, 1},
+	}
+	for i, test := range tests {
+		var calls int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(test.code)
+			fmt.Fprint(w, test.body)
+		}))
+		_, err := newTestClient(ts).Popular(context.Background())
+		ts.Close()
+		if !test.check(err) {
+			t.Errorf("%d got error %#v", i, err)
+		}
+		if calls != test.calls {
+			t.Errorf("%d got %d calls, want %d", i, calls, test.calls)
+		}
+	}
+}
+
+func Test_rateLimit(t *testing.T) {
+	r := &rateLimit{}
+	now := time.Now()
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+	}
+	res.Header.Set("X-Ratelimit-Remaining", "0")
+	res.Header.Set("X-Ratelimit-Reset", fmt.Sprintf("%d", now.Add(time.Hour).Unix()))
+	r.update(res, now)
+
+	// Waiting is cut short by the context.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := r.wait(ctx, "/x", 2*time.Hour); err != context.DeadlineExceeded {
+		t.Errorf("wait got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A wait longer than max isn't made.
+	err := r.wait(context.Background(), "/x", time.Minute)
+	if e, ok := err.(*RateLimitedError); !ok || e.RetryAfter < 59*time.Minute {
+		t.Errorf("wait got %v, want RateLimitedError after an hour", err)
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := p.backoff(attempt)
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d) got %s, want between %s and %s", attempt, d, max/2, max)
+		}
+	}
+}
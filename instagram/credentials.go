@@ -0,0 +1,117 @@
+package instagram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Credentials identify the client to Instagram.
+type Credentials struct {
+	// ClientID identifies the registered client. It's not needed if
+	// AccessToken is set.
+	ClientID string `json:"client_id"`
+	// ClientSecret signs requests when EnforceSigned is set.
+	ClientSecret string `json:"client_secret"`
+	// AccessToken is an OAuth token for a user. If it's set, requests are
+	// authenticated with it instead of ClientID.
+	AccessToken string `json:"access_token"`
+	// EnforceSigned adds a signature made with ClientSecret to each request.
+	// It's required if the client has "Enforce signed requests" enabled.
+	EnforceSigned bool `json:"enforce_signed"`
+}
+
+// DefaultCredentials are used by NewClient. They're the credentials of the
+// original challenge entry.
+var DefaultCredentials = Credentials{
+	ClientID:      "6b2ea4cc0093441fb38990045a855e2a",
+	ClientSecret:  "ea785b48dd014eaeb4fd97c0a23d6ae5",
+	EnforceSigned: true,
+}
+
+// Environment variables read by LoadCredentials.
+const (
+	EnvClientID      = "INSTAGRAM_CLIENT_ID"
+	EnvClientSecret  = "INSTAGRAM_CLIENT_SECRET"
+	EnvAccessToken   = "INSTAGRAM_ACCESS_TOKEN"
+	EnvEnforceSigned = "INSTAGRAM_ENFORCE_SIGNED"
+)
+
+// LoadCredentials reads credentials from a JSON config file, if path isn't
+// empty, and then from environment variables, which take precedence. The
+// config file has the same fields as Credentials:
+//
+//	{"client_id": "...", "client_secret": "...", "enforce_signed": true}
+//
+// EnforceSigned defaults to true when a secret is given. If neither a client
+// id nor an access token is configured, DefaultCredentials are returned.
+func LoadCredentials(path string) (Credentials, error) {
+	var c Credentials
+	var enforce *bool
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		var file struct {
+			Credentials
+			EnforceSigned *bool `json:"enforce_signed"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return c, fmt.Errorf("reading credentials %s: %s", path, err)
+		}
+		c = file.Credentials
+		enforce = file.EnforceSigned
+	}
+	for name, field := range map[string]*string{
+		EnvClientID:     &c.ClientID,
+		EnvClientSecret: &c.ClientSecret,
+		EnvAccessToken:  &c.AccessToken,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+	if v := os.Getenv(EnvEnforceSigned); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s: %s", EnvEnforceSigned, v)
+		}
+		enforce = &b
+	}
+
+	if c.ClientID == "" && c.AccessToken == "" {
+		return DefaultCredentials, nil
+	}
+	if enforce != nil {
+		c.EnforceSigned = *enforce
+	} else {
+		c.EnforceSigned = c.ClientSecret != ""
+	}
+	return c, c.Validate()
+}
+
+// Validate returns an error if the credentials can't be used.
+func (c Credentials) Validate() error {
+	if c.ClientID == "" && c.AccessToken == "" {
+		return fmt.Errorf("instagram credentials need a client id or access token")
+	}
+	if c.EnforceSigned && c.ClientSecret == "" {
+		return fmt.Errorf("instagram credentials need a client secret to sign requests")
+	}
+	return nil
+}
+
+// Signer returns the URLSigner for the credentials.
+func (c Credentials) Signer() URLSigner {
+	var secret string
+	if c.EnforceSigned {
+		secret = c.ClientSecret
+	}
+	if c.AccessToken != "" {
+		return NewAccessTokenSigner(c.AccessToken, secret)
+	}
+	return NewClientIDSigner(c.ClientID, secret)
+}
@@ -0,0 +1,121 @@
+package instagram
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	for _, name := range []string{EnvClientID, EnvClientSecret, EnvAccessToken, EnvEnforceSigned} {
+		t.Setenv(name, "")
+	}
+
+	// Nothing configured.
+	c, err := LoadCredentials("")
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if c != DefaultCredentials {
+		t.Errorf("got %#v, want DefaultCredentials", c)
+	}
+
+	// From a file.
+	dir, err := ioutil.TempDir("", "instagram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "creds.json")
+	ioutil.WriteFile(path, []byte(`{"client_id": "id", "client_secret": "secret"}`), 0600)
+	c, err = LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if want := (Credentials{ClientID: "id", ClientSecret: "secret", EnforceSigned: true}); c != want {
+		t.Errorf("got %#v, want %#v", c, want)
+	}
+
+	// The environment takes precedence.
+	t.Setenv(EnvAccessToken, "token")
+	t.Setenv(EnvEnforceSigned, "false")
+	c, err = LoadCredentials(path)
+	if err != nil {
+		t.Fatalf("got error %s", err)
+	}
+	if want := (Credentials{ClientID: "id", ClientSecret: "secret", AccessToken: "token"}); c != want {
+		t.Errorf("got %#v, want %#v", c, want)
+	}
+
+	// Signing needs a secret.
+	t.Setenv(EnvClientSecret, "")
+	t.Setenv(EnvEnforceSigned, "true")
+	ioutil.WriteFile(path, []byte(`{"client_id": "id"}`), 0600)
+	if _, err := LoadCredentials(path); err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
+
+func TestCredentials_Signer(t *testing.T) {
+	tests := []struct {
+		creds Credentials
+		want  url.Values
+	}{
+		{
+			Credentials{ClientID: "id", ClientSecret: "secret"},
+			url.Values{"client_id": {"id"}},
+		},
+		{
+			Credentials{ClientID: "id", ClientSecret: "secret", EnforceSigned: true},
+			url.Values{"client_id": {"id"}, "sig": {sig("secret", "/media/popular", url.Values{"client_id": {"id"}})}},
+		},
+		{
+			Credentials{AccessToken: "token", ClientSecret: "secret", EnforceSigned: true},
+			url.Values{"access_token": {"token"}, "sig": {sig("secret", "/media/popular", url.Values{"access_token": {"token"}})}},
+		},
+	}
+	for i, test := range tests {
+		q := url.Values{}
+		test.creds.Signer().Sign("/media/popular", &q)
+		if got, want := q.Encode(), test.want.Encode(); got != want {
+			t.Errorf("%d got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	var req *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		fmt.Fprint(w, `{"data":[{"type":"image"}]}`)
+	}))
+	defer ts.Close()
+
+	c := NewClientWithOptions(ClientOptions{
+		BaseURL:     ts.URL + "/v1",
+		HTTPClient:  ts.Client(),
+		Credentials: Credentials{AccessToken: "token"},
+	})
+	list, err := c.Popular(context.Background())
+	if err != nil {
+		t.Fatalf("Popular got error %s", err)
+	}
+	if got, want := len(list.Media), 1; got != want {
+		t.Errorf("got %d media, want %d", got, want)
+	}
+	if got, want := req.URL.Path, "/v1/media/popular"; got != want {
+		t.Errorf("path got %s, want %s", got, want)
+	}
+	if got, want := req.URL.Query().Get("access_token"), "token"; got != want {
+		t.Errorf("access_token got %s, want %s", got, want)
+	}
+	if got := req.URL.Query().Get("sig"); got != "" {
+		t.Errorf("sig got %s, want none", got)
+	}
+}
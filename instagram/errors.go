@@ -0,0 +1,120 @@
+package instagram
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitedError is returned when Instagram refuses a request because too
+// many have been made.
+type RateLimitedError struct {
+	URL string
+	// RetryAfter is how long Instagram asked us to wait, or zero if it
+	// didn't say.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited calling %s, retry after %s", e.URL, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited calling %s", e.URL)
+}
+
+// NotFoundError is returned when the requested resource doesn't exist.
+type NotFoundError struct {
+	URL string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("not found calling %s", e.URL)
+}
+
+// UnauthorizedError is returned when the credentials or signature are
+// rejected.
+type UnauthorizedError struct {
+	URL     string
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return fmt.Sprintf("unauthorized calling %s: %s", e.URL, e.Message)
+}
+
+// StatusError is returned for any other unsuccessful response.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Call to %s failed, status %d %s", e.URL, e.StatusCode, e.Message)
+}
+
+// IsRateLimited returns true if the error is a RateLimitedError.
+func IsRateLimited(err error) bool {
+	_, ok := err.(*RateLimitedError)
+	return ok
+}
+
+// IsNotFound returns true if the error is a NotFoundError.
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// IsUnauthorized returns true if the error is an UnauthorizedError.
+func IsUnauthorized(err error) bool {
+	_, ok := err.(*UnauthorizedError)
+	return ok
+}
+
+// errorMeta is the error description in an Instagram response body.
+type errorMeta struct {
+	Meta struct {
+		Code         int    `json:"code"`
+		ErrorType    string `json:"error_type"`
+		ErrorMessage string `json:"error_message"`
+	} `json:"meta"`
+}
+
+// responseError converts an unsuccessful response to a typed error.
+func responseError(url string, res *http.Response, body []byte) error {
+	var meta errorMeta
+	json.Unmarshal(body, &meta)
+	errType := meta.Meta.ErrorType
+	msg := meta.Meta.ErrorMessage
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests || errType == "OAuthRateLimitException":
+		return &RateLimitedError{url, retryAfter(res, time.Now())}
+	case res.StatusCode == http.StatusNotFound:
+		return &NotFoundError{url}
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return &UnauthorizedError{url, msg}
+	case strings.HasPrefix(errType, "OAuth"):
+		// Instagram reports bad credentials as a 400.
+		return &UnauthorizedError{url, msg}
+	}
+	return &StatusError{url, res.StatusCode, msg}
+}
+
+// retryAfter reads the Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(res *http.Response, now time.Time) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
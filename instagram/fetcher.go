@@ -1,50 +1,185 @@
 package instagram
 
-import "errors"
+import (
+	"context"
+	"time"
+)
 
 // The Fetcher interface fetches media objects.
 type Fetcher interface {
-	// Fetch returns two channels. The first channel receives media
-	// objects. The second channel is done. The caller must close(done) to
-	// stop pulling images.
-	Fetch() (chan *Media, chan struct{})
+	// Fetch returns a channel that receives media objects. The channel is
+	// closed when there is no more media, when an error occurs, or when
+	// ctx is done. Cancel ctx to stop pulling images.
+	Fetch(ctx context.Context) <-chan *Media
+
+	// Err returns the error that stopped the fetch, if any. It's only
+	// valid after the channel is closed.
+	Err() error
 }
 
 type tagFetcher struct {
 	client Client
 	tag    string
+	err    error
 }
 
 // NewTagFetcher gives you a Fetcher that pulls images for a tag.
 func NewTagFetcher(c Client, t string) Fetcher {
-	return &tagFetcher{c, t}
+	return &tagFetcher{client: c, tag: t}
+}
+
+func (f *tagFetcher) Fetch(ctx context.Context) <-chan *Media {
+	ch := make(chan *Media)
+	go func() {
+		defer close(ch)
+		var maxID string
+		for {
+			res, err := f.client.Tagged(ctx, f.tag, maxID)
+			if err != nil {
+				f.err = err
+				return
+			}
+			if !send(ctx, ch, res.Media) {
+				f.err = ctx.Err()
+				return
+			}
+			// The last page has no next id.
+			if res.MaxTagID == "" || len(res.Media) == 0 {
+				return
+			}
+			maxID = res.MaxTagID
+		}
+	}()
+	return ch
 }
 
-func (f tagFetcher) Fetch() (chan *Media, chan struct{}) {
+func (f *tagFetcher) Err() error {
+	return f.err
+}
+
+type popularFetcher struct {
+	client Client
+	err    error
+}
+
+// NewPopularFetcher gives you a Fetcher that pulls popular images. The
+// popular list changes over time, so it's polled until a call returns nothing
+// new.
+func NewPopularFetcher(c Client) Fetcher {
+	return &popularFetcher{client: c}
+}
+
+func (f *popularFetcher) Fetch(ctx context.Context) <-chan *Media {
 	ch := make(chan *Media)
-	done := make(chan struct{})
-	var maxID string
 	go func() {
+		defer close(ch)
+		seen := make(map[string]bool)
 		for {
-			res, err := f.client.Tagged(f.tag, maxID)
-			if err != nil || res == nil {
+			res, err := f.client.Popular(ctx)
+			if err != nil {
+				f.err = err
 				return
 			}
+			var media []Media
 			for _, m := range res.Media {
-				err := func(m Media) error {
-					select {
-					case ch <- &m:
-					case <-done:
-						return errors.New("abort")
-					}
-					return nil
-				}(m)
-				if err != nil {
-					return
+				if key := mediaKey(m); !seen[key] {
+					seen[key] = true
+					media = append(media, m)
 				}
 			}
-			maxID = res.MaxTagID
+			if len(media) == 0 {
+				return
+			}
+			if !send(ctx, ch, media) {
+				f.err = ctx.Err()
+				return
+			}
 		}
 	}()
-	return ch, done
+	return ch
+}
+
+func (f *popularFetcher) Err() error {
+	return f.err
+}
+
+type locationFetcher struct {
+	client Client
+	query  LocationQuery
+	err    error
+}
+
+// NewLocationFetcher gives you a Fetcher that pulls images posted near a
+// location, newest first. Each page asks for media older than the oldest of
+// the previous page, until the query's MinTime is reached or there's no more.
+func NewLocationFetcher(c Client, q LocationQuery) Fetcher {
+	return &locationFetcher{client: c, query: q}
+}
+
+func (f *locationFetcher) Fetch(ctx context.Context) <-chan *Media {
+	ch := make(chan *Media)
+	go func() {
+		defer close(ch)
+		q := f.query
+		for {
+			res, err := f.client.Search(ctx, q)
+			if err != nil {
+				f.err = err
+				return
+			}
+			if !send(ctx, ch, res.Media) {
+				f.err = ctx.Err()
+				return
+			}
+			oldest := oldestMedia(res.Media)
+			// Stop when the page is empty or makes no progress.
+			if oldest.IsZero() || (!q.MaxTime.IsZero() && !oldest.Before(q.MaxTime)) {
+				return
+			}
+			if !q.MinTime.IsZero() && !oldest.After(q.MinTime) {
+				return
+			}
+			q.MaxTime = oldest.Add(-time.Second)
+		}
+	}()
+	return ch
+}
+
+func (f *locationFetcher) Err() error {
+	return f.err
+}
+
+// oldestMedia returns the earliest creation time of the media, or the zero
+// time if none have one.
+func oldestMedia(media []Media) time.Time {
+	var oldest time.Time
+	for _, m := range media {
+		if t := m.Created(); !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+// mediaKey identifies media by its image url.
+func mediaKey(m Media) string {
+	if r := m.ThumbnailImage(); r != nil {
+		return r.URL
+	}
+	if r := m.StandardImage(); r != nil {
+		return r.URL
+	}
+	return ""
+}
+
+// send delivers media to the channel. It returns false if ctx is done first.
+func send(ctx context.Context, ch chan<- *Media, media []Media) bool {
+	for i := range media {
+		select {
+		case ch <- &media[i]:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
@@ -1,8 +1,11 @@
 package instagram
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type tagCall struct {
@@ -14,32 +17,38 @@ type fakeClient struct {
 	mediaLists     []*MediaList
 	mediaListIndex int
 	taggedCalls    []tagCall
+	searchCalls    []LocationQuery
 }
 
-func (c *fakeClient) Popular() (*MediaList, error) {
-	return nil, nil
+func (c *fakeClient) next() (*MediaList, error) {
+	if c.mediaListIndex < len(c.mediaLists) {
+		list := c.mediaLists[c.mediaListIndex]
+		c.mediaListIndex++
+		return list, nil
+	}
+	return nil, fmt.Errorf("no more data")
+}
+
+func (c *fakeClient) Popular(ctx context.Context) (*MediaList, error) {
+	return c.next()
 }
 
-func (c *fakeClient) Search(oat, lng string) (*MediaList, error) {
-	return nil, nil
+func (c *fakeClient) Search(ctx context.Context, q LocationQuery) (*MediaList, error) {
+	c.searchCalls = append(c.searchCalls, q)
+	return c.next()
 }
 
-func (c *fakeClient) Tagged(tag string, maxID string) (*MediaList, error) {
+func (c *fakeClient) Tagged(ctx context.Context, tag string, maxID string) (*MediaList, error) {
 	c.taggedCalls = append(c.taggedCalls, tagCall{
 		tag,
 		maxID,
 	})
-	if c.mediaListIndex < len(c.mediaLists) {
-		list := c.mediaLists[c.mediaListIndex]
-		c.mediaListIndex++
-		return list, nil
-	}
-	return nil, fmt.Errorf("no more data")
+	return c.next()
 }
 
 func Test_tagFetcher_Fetch(t *testing.T) {
 	c := &fakeClient{}
-	f := tagFetcher{c, "cat"}
+	f := &tagFetcher{client: c, tag: "cat"}
 
 	list1 := &MediaList{
 		Media: []Media{
@@ -63,24 +72,21 @@ func Test_tagFetcher_Fetch(t *testing.T) {
 	}
 
 	c.mediaLists = []*MediaList{list1, list2}
-	ch, done := f.Fetch()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := f.Fetch(ctx)
 
-	var m *Media
 	var media []*Media
-
-	go func() {
-		for {
-			select {
-			case m = <-ch:
-				media = append(media, m)
-				if len(media) == 3 {
-					close(done)
-					return
-				}
-			}
+	for m := range ch {
+		media = append(media, m)
+		if len(media) == 3 {
+			cancel()
+			break
 		}
-	}()
-	<-done
+	}
+	// Drain until the fetcher notices the cancel.
+	for range ch {
+	}
 
 	if got, want := len(media), 3; got != want {
 		t.Errorf("got %d records, want %d", got, want)
@@ -95,3 +101,121 @@ func Test_tagFetcher_Fetch(t *testing.T) {
 		t.Errorf("calls 1, want %s, got %s", got, want)
 	}
 }
+
+func Test_tagFetcher_Fetch_exhausted(t *testing.T) {
+	c := &fakeClient{}
+	f := &tagFetcher{client: c, tag: "cat"}
+	c.mediaLists = []*MediaList{
+		{Media: []Media{{Type: "i1"}}, Pagination: Pagination{MaxTagID: "list2"}},
+		{Media: []Media{{Type: "i2"}}},
+	}
+	var media []*Media
+	for m := range f.Fetch(context.Background()) {
+		media = append(media, m)
+	}
+	if got, want := len(media), 2; got != want {
+		t.Errorf("got %d records, want %d", got, want)
+	}
+	if err := f.Err(); err != nil {
+		t.Errorf("Err got %s, want nil", err)
+	}
+}
+
+func Test_tagFetcher_Fetch_error(t *testing.T) {
+	c := &fakeClient{}
+	f := &tagFetcher{client: c, tag: "cat"}
+	for range f.Fetch(context.Background()) {
+	}
+	if f.Err() == nil {
+		t.Errorf("Err got nil, want error")
+	}
+}
+
+// fakeMedia returns media with a thumbnail url and creation time.
+func fakeMedia(url string, created int64) Media {
+	return Media{
+		Type:        "image",
+		CreatedTime: strconv.FormatInt(created, 10),
+		Images:      map[string]*Rep{"thumbnail": {URL: url}},
+	}
+}
+
+func Test_popularFetcher_Fetch(t *testing.T) {
+	c := &fakeClient{}
+	f := NewPopularFetcher(c)
+	c.mediaLists = []*MediaList{
+		{Media: []Media{fakeMedia("a", 0), fakeMedia("b", 0)}},
+		{Media: []Media{fakeMedia("b", 0), fakeMedia("c", 0)}},
+		{Media: []Media{fakeMedia("a", 0), fakeMedia("c", 0)}},
+	}
+	var urls []string
+	for m := range f.Fetch(context.Background()) {
+		urls = append(urls, m.ThumbnailImage().URL)
+	}
+	if err := f.Err(); err != nil {
+		t.Errorf("Err got %s, want nil", err)
+	}
+	if got, want := fmt.Sprint(urls), "[a b c]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := c.mediaListIndex, 3; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+}
+
+func Test_locationFetcher_Fetch(t *testing.T) {
+	c := &fakeClient{}
+	q := LocationQuery{
+		Lat:      "37.7",
+		Lng:      "-122.4",
+		Distance: 500,
+		MinTime:  time.Unix(100, 0),
+	}
+	f := NewLocationFetcher(c, q)
+	c.mediaLists = []*MediaList{
+		{Media: []Media{fakeMedia("a", 300), fakeMedia("b", 250)}},
+		{Media: []Media{fakeMedia("c", 200), fakeMedia("d", 90)}},
+		{Media: []Media{fakeMedia("e", 80)}},
+	}
+	var media []*Media
+	for m := range f.Fetch(context.Background()) {
+		media = append(media, m)
+	}
+	if err := f.Err(); err != nil {
+		t.Errorf("Err got %s, want nil", err)
+	}
+	if got, want := len(media), 4; got != want {
+		t.Errorf("got %d records, want %d", got, want)
+	}
+	if got, want := len(c.searchCalls), 2; got != want {
+		t.Fatalf("got %d calls, want %d", got, want)
+	}
+	if got := c.searchCalls[0].MaxTime; !got.IsZero() {
+		t.Errorf("call 0 MaxTime got %s, want zero", got)
+	}
+	if got, want := c.searchCalls[1].MaxTime, time.Unix(249, 0); !got.Equal(want) {
+		t.Errorf("call 1 MaxTime got %s, want %s", got, want)
+	}
+	if got, want := c.searchCalls[1].Distance, 500; got != want {
+		t.Errorf("call 1 Distance got %d, want %d", got, want)
+	}
+}
+
+func Test_locationFetcher_Fetch_exhausted(t *testing.T) {
+	c := &fakeClient{}
+	f := NewLocationFetcher(c, LocationQuery{Lat: "1", Lng: "2"})
+	c.mediaLists = []*MediaList{
+		{Media: []Media{fakeMedia("a", 300)}},
+		{},
+	}
+	var media []*Media
+	for m := range f.Fetch(context.Background()) {
+		media = append(media, m)
+	}
+	if err := f.Err(); err != nil {
+		t.Errorf("Err got %s, want nil", err)
+	}
+	if got, want := len(media), 1; got != want {
+		t.Errorf("got %d records, want %d", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package instagramtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fixtures are the data served by a Server. Media are the JSON objects in the
+// "data" list of an API response.
+type Fixtures struct {
+	// Tags maps a tag to its pages of media.
+	Tags map[string][][]json.RawMessage
+	// Popular are the pages of media returned by successive calls to the
+	// popular endpoint. The last page is repeated.
+	Popular [][]json.RawMessage
+	// Search is all the media that can be found by location. Each search
+	// returns those within its time window, newest first.
+	Search []json.RawMessage
+	// Images maps a file name to JPEG data.
+	Images map[string][]byte
+}
+
+// LoadFixtures reads fixtures recorded in a directory:
+//
+//	tags/<tag>/<page>.json  responses for a tag, pages numbered from 1
+//	popular/<page>.json     responses for popular
+//	search/<page>.json      responses for search, combined
+//	images/<name>.jpg       thumbnails, matched to urls by name
+func LoadFixtures(dir string) (*Fixtures, error) {
+	f := &Fixtures{
+		Tags:   make(map[string][][]json.RawMessage),
+		Images: make(map[string][]byte),
+	}
+	tagDirs, err := ioutil.ReadDir(filepath.Join(dir, "tags"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range tagDirs {
+		if !info.IsDir() {
+			continue
+		}
+		pages, err := loadPages(filepath.Join(dir, "tags", info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		f.Tags[info.Name()] = pages
+	}
+	if f.Popular, err = loadPages(filepath.Join(dir, "popular")); err != nil {
+		return nil, err
+	}
+	search, err := loadPages(filepath.Join(dir, "search"))
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range search {
+		f.Search = append(f.Search, page...)
+	}
+	images, err := ioutil.ReadDir(filepath.Join(dir, "images"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range images {
+		if info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "images", info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		f.Images[info.Name()] = data
+	}
+	return f, nil
+}
+
+// loadPages reads the numbered JSON responses in a directory, in order.
+func loadPages(dir string) ([][]json.RawMessage, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	numbers := []int{}
+	for _, info := range infos {
+		name := info.Name()
+		if n, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil && strings.HasSuffix(name, ".json") {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	pages := make([][]json.RawMessage, 0, len(numbers))
+	for _, n := range numbers {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", n))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, fmt.Errorf("reading fixture %s: %s", path, err)
+		}
+		pages = append(pages, res.Data)
+	}
+	return pages, nil
+}
+
+// GenerateFixtures makes fixtures with pages of media for a tag, each with a
+// solid colored thumbnail. The same media is also served as popular and
+// location search results, a minute apart, ending at now.
+func GenerateFixtures(tag string, pages, perPage int) *Fixtures {
+	f := &Fixtures{
+		Tags:   make(map[string][][]json.RawMessage),
+		Images: make(map[string][]byte),
+	}
+	total := pages * perPage
+	now := time.Now().Unix()
+	var tagPages [][]json.RawMessage
+	for p := 0; p < pages; p++ {
+		var page []json.RawMessage
+		for i := 0; i < perPage; i++ {
+			n := p*perPage + i
+			name := fmt.Sprintf("%s-%d.jpg", tag, n)
+			f.Images[name] = solidJPEG(hue(n, total))
+			m := fakeMedia(name, now-int64(n)*60)
+			page = append(page, m)
+			f.Search = append(f.Search, m)
+		}
+		tagPages = append(tagPages, page)
+	}
+	f.Tags[tag] = tagPages
+	f.Popular = tagPages
+	return f
+}
+
+// fakeMedia is the JSON for an image with a thumbnail and standard
+// resolution representation.
+func fakeMedia(name string, created int64) json.RawMessage {
+	url := "http://images.example.com/" + name
+	m := map[string]interface{}{
+		"type":         "image",
+		"created_time": strconv.FormatInt(created, 10),
+		"images": map[string]interface{}{
+			"thumbnail":           map[string]interface{}{"url": url, "width": 150, "height": 150},
+			"standard_resolution": map[string]interface{}{"url": url, "width": 150, "height": 150},
+		},
+	}
+	js, _ := json.Marshal(m)
+	return js
+}
+
+// hue returns the nth of total colors spread around the color wheel.
+func hue(n, total int) color.Color {
+	h := float64(n) / float64(total) * 6
+	x := uint8(255 * (1 - abs(mod2(h)-1)))
+	switch int(h) {
+	case 0:
+		return color.RGBA{255, x, 0, 255}
+	case 1:
+		return color.RGBA{x, 255, 0, 255}
+	case 2:
+		return color.RGBA{0, 255, x, 255}
+	case 3:
+		return color.RGBA{0, x, 255, 255}
+	case 4:
+		return color.RGBA{x, 0, 255, 255}
+	}
+	return color.RGBA{255, 0, x, 255}
+}
+
+func mod2(f float64) float64 {
+	return f - 2*float64(int(f/2))
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
+
+func solidJPEG(c color.Color) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 150, 150))
+	draw.Draw(m, m.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, m, nil)
+	return buf.Bytes()
+}
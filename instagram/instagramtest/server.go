@@ -0,0 +1,317 @@
+// Package instagramtest provides a fake Instagram API server for tests.
+//
+// The server answers the tag, popular and search endpoints with pages of
+// fixture JSON, and serves thumbnail JPEGs from the fixtures. Image urls in
+// the JSON whose file name matches a fixture image are rewritten to point at
+// the server, so recorded API responses can be replayed as-is. Failures and
+// latency can be injected to test retries and timeouts.
+package instagramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure describes requests that the server fails.
+type Failure struct {
+	// Path matches requests whose path starts with it, such as
+	// "/v1/tags/". Empty matches all requests.
+	Path string
+	// Status is the HTTP status code to respond with.
+	Status int
+	// ErrorType is the meta error_type in the body, such as
+	// "OAuthRateLimitException".
+	ErrorType string
+	// RetryAfter, if set, is sent as the Retry-After header in seconds.
+	RetryAfter int
+	// Times is how many requests fail. Zero fails every request.
+	Times int
+}
+
+// Server is a fake Instagram API.
+type Server struct {
+	*httptest.Server
+	fixtures *Fixtures
+
+	mu       sync.Mutex
+	latency  time.Duration
+	failures []*Failure
+	requests map[string]int
+}
+
+// NewServer starts a server for the fixtures. The API is at URL+"/v1", to use
+// as the client's base URL. Call Close when you're done.
+func NewServer(f *Fixtures) *Server {
+	s := NewUnstartedServer(f)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server for the fixtures without starting it,
+// so that its listener can be changed.
+func NewUnstartedServer(f *Fixtures) *Server {
+	s := &Server{
+		fixtures: f,
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// APIURL is the base URL of the API.
+func (s *Server) APIURL() string {
+	return s.URL + "/v1"
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Fail injects a failure. Failures are checked in the order they're added.
+func (s *Server) Fail(f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &f)
+}
+
+// Requests returns how many requests were made with a path starting with
+// prefix.
+func (s *Server) Requests(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for p, c := range s.requests {
+		if strings.HasPrefix(p, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	latency := s.latency
+	failure := s.failure(r.URL.Path)
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if failure != nil {
+		if failure.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(failure.RetryAfter))
+		}
+		s.respond(w, failure.Status, errorBody(failure.Status, failure.ErrorType))
+		return
+	}
+
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/images/"):
+		s.serveImage(w, r, path.Base(p))
+	case p == "/v1/media/popular":
+		s.servePopular(w, r)
+	case p == "/v1/media/search":
+		s.serveSearch(w, r)
+	case strings.HasPrefix(p, "/v1/tags/") && strings.HasSuffix(p, "/media/recent"):
+		tag := strings.TrimSuffix(strings.TrimPrefix(p, "/v1/tags/"), "/media/recent")
+		s.serveTag(w, r, tag)
+	default:
+		s.respond(w, http.StatusNotFound, errorBody(http.StatusNotFound, "APINotFoundError"))
+	}
+}
+
+// failure returns the failure for a request, if any. Must hold mu.
+func (s *Server) failure(p string) *Failure {
+	for i, f := range s.failures {
+		if !strings.HasPrefix(p, f.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// serveTag serves a page of tagged media. The max_tag_id is the page number.
+func (s *Server) serveTag(w http.ResponseWriter, r *http.Request, tag string) {
+	pages, ok := s.fixtures.Tags[tag]
+	if !ok {
+		s.respond(w, http.StatusOK, s.page(nil, ""))
+		return
+	}
+	n := 0
+	if id := r.FormValue("max_tag_id"); id != "" {
+		var err error
+		if n, err = strconv.Atoi(id); err != nil || n < 0 {
+			s.respond(w, http.StatusBadRequest, errorBody(http.StatusBadRequest, "APIInvalidParametersError"))
+			return
+		}
+	}
+	if n >= len(pages) {
+		s.respond(w, http.StatusOK, s.page(nil, ""))
+		return
+	}
+	var next string
+	if n+1 < len(pages) {
+		next = strconv.Itoa(n + 1)
+	}
+	s.respond(w, http.StatusOK, s.page(pages[n], next))
+}
+
+// servePopular serves the popular pages in turn, repeating the last.
+func (s *Server) servePopular(w http.ResponseWriter, r *http.Request) {
+	pages := s.fixtures.Popular
+	n := s.Requests("/v1/media/popular") - 1
+	if n >= len(pages) {
+		n = len(pages) - 1
+	}
+	if n < 0 {
+		s.respond(w, http.StatusOK, s.page(nil, ""))
+		return
+	}
+	s.respond(w, http.StatusOK, s.page(pages[n], ""))
+}
+
+// serveSearch serves the search media within the time window, newest first.
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("lat") == "" || r.FormValue("lng") == "" {
+		s.respond(w, http.StatusBadRequest, errorBody(http.StatusBadRequest, "APIInvalidParametersError"))
+		return
+	}
+	min, _ := strconv.ParseInt(r.FormValue("min_timestamp"), 10, 64)
+	max, _ := strconv.ParseInt(r.FormValue("max_timestamp"), 10, 64)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+
+	var media []json.RawMessage
+	for _, m := range s.fixtures.Search {
+		created := createdTime(m)
+		if (min > 0 && created < min) || (max > 0 && created > max) {
+			continue
+		}
+		media = append(media, m)
+	}
+	sort.SliceStable(media, func(i, j int) bool {
+		return createdTime(media[i]) > createdTime(media[j])
+	})
+	if count > 0 && len(media) > count {
+		media = media[:count]
+	}
+	s.respond(w, http.StatusOK, s.page(media, ""))
+}
+
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, name string) {
+	data, ok := s.fixtures.Images[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(data)
+}
+
+// page renders a page of media with its pagination, rewriting image urls to
+// the server.
+func (s *Server) page(media []json.RawMessage, nextMaxTagID string) interface{} {
+	data := make([]interface{}, 0, len(media))
+	for _, m := range media {
+		var v interface{}
+		if err := json.Unmarshal(m, &v); err != nil {
+			continue
+		}
+		data = append(data, s.rewrite(v))
+	}
+	pagination := map[string]string{}
+	if nextMaxTagID != "" {
+		pagination["next_max_tag_id"] = nextMaxTagID
+	}
+	return map[string]interface{}{
+		"meta":       map[string]int{"code": http.StatusOK},
+		"data":       data,
+		"pagination": pagination,
+	}
+}
+
+// rewrite points image urls at the server when there's a fixture image with
+// the same name.
+func (s *Server) rewrite(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, x := range t {
+			if u, ok := x.(string); ok && k == "url" {
+				if _, ok := s.fixtures.Images[imageName(u)]; ok {
+					t[k] = s.URL + "/images/" + imageName(u)
+				}
+				continue
+			}
+			t[k] = s.rewrite(x)
+		}
+	case []interface{}:
+		for i, x := range t {
+			t[i] = s.rewrite(x)
+		}
+	}
+	return v
+}
+
+func (s *Server) respond(w http.ResponseWriter, code int, body interface{}) {
+	js, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(js)
+}
+
+func errorBody(code int, errorType string) interface{} {
+	if errorType == "" {
+		errorType = "APIError"
+	}
+	return map[string]interface{}{
+		"meta": map[string]interface{}{
+			"code":          code,
+			"error_type":    errorType,
+			"error_message": fmt.Sprintf("fake %s", http.StatusText(code)),
+		},
+	}
+}
+
+// imageName is the file name in an image url, without any query string.
+func imageName(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	return path.Base(u)
+}
+
+func createdTime(m json.RawMessage) int64 {
+	var t struct {
+		CreatedTime string `json:"created_time"`
+	}
+	json.Unmarshal(m, &t)
+	n, _ := strconv.ParseInt(t.CreatedTime, 10, 64)
+	return n
+}
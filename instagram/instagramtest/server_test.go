@@ -0,0 +1,115 @@
+package instagramtest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
+)
+
+func newTestClient(s *Server) instagram.Client {
+	return instagram.NewClientWithOptions(instagram.ClientOptions{
+		BaseURL: s.APIURL(),
+		Retry:   instagram.RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+}
+
+func fetchAll(t *testing.T, f instagram.Fetcher) []*instagram.Media {
+	var media []*instagram.Media
+	for m := range f.Fetch(context.Background()) {
+		media = append(media, m)
+	}
+	if err := f.Err(); err != nil {
+		t.Fatalf("Err got %s", err)
+	}
+	return media
+}
+
+func TestServer_recorded(t *testing.T) {
+	f, err := LoadFixtures("../../fixtures/instagram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(f)
+	defer s.Close()
+	c := newTestClient(s)
+
+	media := fetchAll(t, instagram.NewTagFetcher(c, "cat"))
+	if got, want := len(media), 8; got != want {
+		t.Fatalf("got %d media, want %d", got, want)
+	}
+	if got, want := s.Requests("/v1/tags/cat/"), 2; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+	m, err := media[0].ThumbnailImage().Image(context.Background())
+	if err != nil {
+		t.Fatalf("Image got error %s", err)
+	}
+	if got, want := m.Bounds().Dx(), instagram.ThumbnailSize; got != want {
+		t.Errorf("Dx got %d, want %d", got, want)
+	}
+
+	if got, want := len(fetchAll(t, instagram.NewPopularFetcher(c))), 4; got != want {
+		t.Errorf("popular got %d media, want %d", got, want)
+	}
+	q := instagram.LocationQuery{Lat: "37.77", Lng: "-122.42"}
+	if got, want := len(fetchAll(t, instagram.NewLocationFetcher(c, q))), 4; got != want {
+		t.Errorf("search got %d media, want %d", got, want)
+	}
+}
+
+func TestServer_generated(t *testing.T) {
+	s := NewServer(GenerateFixtures("dog", 3, 5))
+	defer s.Close()
+	c := newTestClient(s)
+
+	media := fetchAll(t, instagram.NewTagFetcher(c, "dog"))
+	if got, want := len(media), 15; got != want {
+		t.Fatalf("got %d media, want %d", got, want)
+	}
+	if _, err := media[14].ThumbnailImage().Image(context.Background()); err != nil {
+		t.Errorf("Image got error %s", err)
+	}
+	if got := len(fetchAll(t, instagram.NewTagFetcher(c, "unknown"))); got != 0 {
+		t.Errorf("unknown tag got %d media, want 0", got)
+	}
+	q := instagram.LocationQuery{Lat: "1", Lng: "2", MinTime: time.Now().Add(-270 * time.Second)}
+	if got, want := len(fetchAll(t, instagram.NewLocationFetcher(c, q))), 5; got != want {
+		t.Errorf("search got %d media, want %d", got, want)
+	}
+}
+
+func TestServer_Fail(t *testing.T) {
+	s := NewServer(GenerateFixtures("dog", 1, 1))
+	defer s.Close()
+	c := newTestClient(s)
+
+	// Retried until the failures run out.
+	s.Fail(Failure{Path: "/v1/tags/", Status: http.StatusServiceUnavailable, Times: 2})
+	if _, err := c.Tagged(context.Background(), "dog", ""); err != nil {
+		t.Errorf("Tagged got error %s", err)
+	}
+	if got, want := s.Requests("/v1/tags/"), 3; got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+
+	s.Fail(Failure{Status: http.StatusBadRequest, ErrorType: "OAuthAccessTokenException"})
+	if _, err := c.Popular(context.Background()); !instagram.IsUnauthorized(err) {
+		t.Errorf("Popular got %v, want unauthorized", err)
+	}
+}
+
+func TestServer_SetLatency(t *testing.T) {
+	s := NewServer(GenerateFixtures("dog", 1, 1))
+	defer s.Close()
+	c := newTestClient(s)
+
+	s.SetLatency(time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Popular(ctx); err == nil {
+		t.Errorf("Popular got nil, want error")
+	}
+}
@@ -0,0 +1,66 @@
+package instagram
+
+import (
+	"context"
+	"image"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+// fetcherSource adapts a Fetcher to a source.Source of thumbnail images.
+type fetcherSource struct {
+	Fetcher
+}
+
+// NewSource gives you a source.Source of the thumbnail images of the media
+// pulled by a Fetcher.
+func NewSource(f Fetcher) source.Source {
+	return fetcherSource{f}
+}
+
+func (s fetcherSource) Items(ctx context.Context) <-chan source.Item {
+	ch := make(chan source.Item)
+	go func() {
+		defer close(ch)
+		for m := range s.Fetch(ctx) {
+			if !source.Send(ctx, ch, thumbnailItem{m}) {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// thumbnailItem is the thumbnail image of a media, identified by its URL.
+type thumbnailItem struct {
+	*Media
+}
+
+func (t thumbnailItem) ID() string {
+	return t.ThumbnailImage().URL
+}
+
+// Attribution credits the user who posted the media.
+func (t thumbnailItem) Attribution() source.Attribution {
+	a := source.Attribution{
+		Author:   t.User.FullName,
+		Username: t.User.Username,
+		Link:     t.Link,
+		Tags:     t.Tags,
+		Created:  t.Created(),
+	}
+	if a.Author == "" {
+		a.Author = t.User.Username
+	}
+	if t.User.Username != "" {
+		a.AuthorURL = "https://instagram.com/" + t.User.Username
+	}
+	if t.Caption != nil {
+		a.Caption = t.Caption.Text
+	}
+	return a
+}
+
+func (t thumbnailItem) Image(ctx context.Context) (image.Image, error) {
+	return t.ThumbnailImage().Image(ctx)
+}
@@ -0,0 +1,57 @@
+package instagram
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewSource(t *testing.T) {
+	c := &fakeClient{}
+	m := Media{
+		Type:   "image",
+		Images: map[string]*Rep{"thumbnail": NewFakeRep("/1")},
+	}
+	c.mediaLists = []*MediaList{{Media: []Media{m}}}
+	s := NewSource(NewTagFetcher(c, "cat"))
+
+	var ids []string
+	for item := range s.Items(context.Background()) {
+		ids = append(ids, item.ID())
+		if _, err := item.Image(context.Background()); err != nil {
+			t.Errorf("Image got error %s", err)
+		}
+	}
+	if len(ids) != 1 || ids[0] != "/1" {
+		t.Errorf("got ids %v, want [/1]", ids)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("Err got %s, want nil", err)
+	}
+}
+
+func Test_thumbnailItem_Attribution(t *testing.T) {
+	m := &Media{
+		Type:        "image",
+		CreatedTime: "1430000000",
+		Link:        "https://instagram.com/p/abc/",
+		User:        User{Username: "kitty", FullName: "Kitty Cat"},
+		Caption:     &Caption{Text: "meow"},
+		Tags:        []string{"cat"},
+	}
+	a := thumbnailItem{m}.Attribution()
+	if got, want := a.Author, "Kitty Cat"; got != want {
+		t.Errorf("Author got %s, want %s", got, want)
+	}
+	if got, want := a.AuthorURL, "https://instagram.com/kitty"; got != want {
+		t.Errorf("AuthorURL got %s, want %s", got, want)
+	}
+	if got, want := a.Caption, "meow"; got != want {
+		t.Errorf("Caption got %s, want %s", got, want)
+	}
+	if got, want := a.Link, m.Link; got != want {
+		t.Errorf("Link got %s, want %s", got, want)
+	}
+	if got, want := a.Created.Unix(), int64(1430000000); got != want {
+		t.Errorf("Created got %d, want %d", got, want)
+	}
+}
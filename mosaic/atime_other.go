@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package mosaic
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns when a file was last read. Access times aren't available
+// on this platform, so it's the modification time.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
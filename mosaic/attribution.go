@@ -0,0 +1,167 @@
+package mosaic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+// AttributionCache is implemented by caches that can store who created an
+// image alongside it.
+type AttributionCache interface {
+	// PutAttribution stores the attribution of the image at key.
+	PutAttribution(ImageCacheKey, source.Attribution) error
+
+	// GetAttribution returns the attribution of the image at key. It
+	// returns a NotCachedError if there is none.
+	GetAttribution(ImageCacheKey) (source.Attribution, error)
+}
+
+// Attribution returns who created the image at key. It returns a
+// NotCachedError if the inventory doesn't know.
+func (ii *ImageInventory) Attribution(key ImageCacheKey) (source.Attribution, error) {
+	ac, ok := ii.cache.(AttributionCache)
+	if !ok {
+		return source.Attribution{}, &NotCachedError{key}
+	}
+	return ac.GetAttribution(key)
+}
+
+// Credit attributes an image used in a mosaic.
+type Credit struct {
+	Key ImageCacheKey `json:"key"`
+	// Tiles is how many times the image was used.
+	Tiles int `json:"tiles"`
+	source.Attribution
+}
+
+// Credits returns the attribution of the inventory's images that have been
+// used from the palette, most used first. Images with no known attribution
+// are included with only their key.
+func (ii *ImageInventory) Credits(p *ImagePalette) ([]Credit, error) {
+	used := p.Used()
+	credits := make([]Credit, 0, len(used))
+	for key, n := range used {
+		a, err := ii.Attribution(key)
+		if err != nil && !IsNotCached(err) {
+			return nil, err
+		}
+		credits = append(credits, Credit{key, n, a})
+	}
+	sort.Slice(credits, func(i, j int) bool {
+		if credits[i].Tiles != credits[j].Tiles {
+			return credits[i].Tiles > credits[j].Tiles
+		}
+		return credits[i].Key < credits[j].Key
+	})
+	return credits, nil
+}
+
+// storeAttribution saves the item's attribution, if it has one and the cache
+// can store it.
+func storeAttribution(cache ImageCache, key ImageCacheKey, item source.Item) error {
+	ac, ok := cache.(AttributionCache)
+	if !ok {
+		return nil
+	}
+	attributed, ok := item.(source.Attributed)
+	if !ok {
+		return nil
+	}
+	return ac.PutAttribution(key, attributed.Attribution())
+}
+
+func (c fileImageCache) PutAttribution(key ImageCacheKey, a source.Attribution) error {
+	js, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	c.locks.Lock(key)
+	defer c.locks.Unlock(key)
+
+	fo, err := ioutil.TempFile(c.Dir, fmt.Sprintf(".%s.*.tmp", key))
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+	if _, err := fo.Write(js); err != nil {
+		fo.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fo.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, c.keyToAttributionPath(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (c fileImageCache) GetAttribution(key ImageCacheKey) (source.Attribution, error) {
+	c.locks.RLock(key)
+	defer c.locks.RUnlock(key)
+
+	var a source.Attribution
+	js, err := ioutil.ReadFile(c.keyToAttributionPath(key))
+	if os.IsNotExist(err) {
+		return a, &NotCachedError{key}
+	}
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal(js, &a)
+	return a, err
+}
+
+// keyToAttributionPath is the file beside the image that holds its
+// attribution.
+func (c fileImageCache) keyToAttributionPath(key ImageCacheKey) string {
+	return fmt.Sprintf("%s/%s.json", c.Dir, key)
+}
+
+func (c s3ImageCache) PutAttribution(key ImageCacheKey, a source.Attribution) error {
+	js, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	res, err := c.do("PUT", c.keyToAttributionObject(key), nil, js)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put %s attribution failed, status %d", key, res.StatusCode)
+	}
+	return nil
+}
+
+func (c s3ImageCache) GetAttribution(key ImageCacheKey) (source.Attribution, error) {
+	var a source.Attribution
+	res, err := c.do("GET", c.keyToAttributionObject(key), nil, nil)
+	if err != nil {
+		return a, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return a, &NotCachedError{key}
+	}
+	if res.StatusCode != http.StatusOK {
+		return a, fmt.Errorf("s3 get %s attribution failed, status %d", key, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&a)
+	return a, err
+}
+
+// keyToAttributionObject is the object beside the image that holds its
+// attribution.
+func (c s3ImageCache) keyToAttributionObject(key ImageCacheKey) string {
+	return fmt.Sprintf("%s/%s.json", c.Prefix, key)
+}
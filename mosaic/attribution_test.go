@@ -0,0 +1,131 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+// attributedItem is a fakeItem that knows who created it.
+type attributedItem struct {
+	fakeItem
+	author string
+}
+
+func (a attributedItem) Attribution() source.Attribution {
+	return source.Attribution{
+		Author:  a.author,
+		Link:    "http://example.com" + a.url,
+		Created: time.Unix(1430000000, 0),
+	}
+}
+
+func testAttributionCache(t *testing.T, c ImageCache) {
+	ac := c.(AttributionCache)
+	key := c.Key("/1")
+	if _, err := ac.GetAttribution(key); !IsNotCached(err) {
+		t.Errorf("GetAttribution got %v, want NotCachedError", err)
+	}
+	want := source.Attribution{Author: "kitty", Tags: []string{"cat"}, Created: time.Unix(1430000000, 0)}
+	if err := ac.PutAttribution(key, want); err != nil {
+		t.Fatalf("PutAttribution got error %s", err)
+	}
+	c.Put(key, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	got, err := ac.GetAttribution(key)
+	if err != nil {
+		t.Fatalf("GetAttribution got error %s", err)
+	}
+	if got.Author != want.Author || len(got.Tags) != 1 || !got.Created.Equal(want.Created) {
+		t.Errorf("GetAttribution got %#v, want %#v", got, want)
+	}
+	if got, want := c.Size(), 1; got != want {
+		t.Errorf("Size got %d, want %d", got, want)
+	}
+	if err := c.Delete(key); err != nil {
+		t.Fatalf("Delete got error %s", err)
+	}
+	if _, err := ac.GetAttribution(key); !IsNotCached(err) {
+		t.Errorf("GetAttribution after Delete got %v, want NotCachedError", err)
+	}
+}
+
+func Test_fileImageCache_Attribution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attribution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testAttributionCache(t, NewFileImageCache(dir))
+}
+
+func Test_s3ImageCache_Attribution(t *testing.T) {
+	c, _, done := newFakeS3Cache("cat")
+	defer done()
+	testAttributionCache(t, c)
+}
+
+func TestImageInventory_Credits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ii := NewImageInventory(NewFileImageCache(dir))
+
+	red := image.NewUniform(color.RGBA{255, 0, 0, 255})
+	blue := image.NewUniform(color.RGBA{0, 0, 255, 255})
+	redImg := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	blueImg := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			redImg.Set(x, y, red.C)
+			blueImg.Set(x, y, blue.C)
+		}
+	}
+	src := &fakeSource{
+		items: []source.Item{
+			attributedItem{fakeItem{"/red", redImg}, "Red"},
+			fakeItem{"/blue", blueImg},
+		},
+	}
+	if err := ii.Fetch(context.Background(), src, 2); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	a, err := ii.Attribution(ii.cache.Key("/red"))
+	if err != nil {
+		t.Fatalf("Attribution got error %s", err)
+	}
+	if got, want := a.Author, "Red"; got != want {
+		t.Errorf("Author got %s, want %s", got, want)
+	}
+
+	p := NewImagePalette(2)
+	if err := ii.PopulatePalette(p); err != nil {
+		t.Fatal(err)
+	}
+	p.AtColor(red.C)
+	p.AtColor(red.C)
+	p.AtColor(blue.C)
+	credits, err := ii.Credits(p)
+	if err != nil {
+		t.Fatalf("Credits got error %s", err)
+	}
+	if got, want := len(credits), 2; got != want {
+		t.Fatalf("got %d credits, want %d", got, want)
+	}
+	if got, want := credits[0].Author, "Red"; got != want {
+		t.Errorf("credit 0 Author got %s, want %s", got, want)
+	}
+	if got, want := credits[0].Tiles, 2; got != want {
+		t.Errorf("credit 0 Tiles got %d, want %d", got, want)
+	}
+	if got, want := credits[1].Author, ""; got != want {
+		t.Errorf("credit 1 Author got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package mosaic
+
+import (
+	"image"
+	"sort"
+)
+
+// RejectDuplicates makes Fetch skip images whose hash is within maxDistance
+// of an image already in the inventory. Reposts and near-identical crops
+// otherwise pile into the same palette color and make mosaics repetitive.
+func (ii *ImageInventory) RejectDuplicates(fn HashFunc, maxDistance int) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	ii.hashFunc = fn
+	ii.maxDistance = maxDistance
+	ii.hashes = nil
+}
+
+// isDuplicate returns true if the image is a near-duplicate of one in the
+// inventory. If it's not, the image's hash is recorded under key.
+func (ii *ImageInventory) isDuplicate(key ImageCacheKey, m image.Image) (bool, error) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	if ii.hashFunc == nil {
+		return false, nil
+	}
+	if ii.hashes == nil {
+		hashes, err := hashCache(ii.cache, ii.hashFunc)
+		if err != nil {
+			return false, err
+		}
+		ii.hashes = hashes
+	}
+	h := ii.hashFunc(m)
+	for _, o := range ii.hashes {
+		if h.Distance(o) <= ii.maxDistance {
+			return true, nil
+		}
+	}
+	ii.hashes[key] = h
+	return false, nil
+}
+
+// RemoveDuplicates deletes images in the inventory that are within
+// maxDistance of another image, keeping the first by key. It returns the keys
+// that were removed.
+func (ii *ImageInventory) RemoveDuplicates(fn HashFunc, maxDistance int) ([]ImageCacheKey, error) {
+	hashes, err := hashCache(ii.cache, fn)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(hashes))
+	for k := range hashes {
+		keys = append(keys, string(k))
+	}
+	sort.Strings(keys)
+
+	removed := []ImageCacheKey{}
+	kept := make([]ImageHash, 0, len(keys))
+	for _, k := range keys {
+		key := ImageCacheKey(k)
+		h := hashes[key]
+		var dup bool
+		for _, o := range kept {
+			if h.Distance(o) <= maxDistance {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			kept = append(kept, h)
+			continue
+		}
+		if err := ii.cache.Delete(key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, key)
+	}
+
+	ii.forgetHashes()
+	return removed, nil
+}
+
+// forgetHashes clears known hashes after images are removed, so that they're
+// recalculated on the next Fetch.
+func (ii *ImageInventory) forgetHashes() {
+	ii.mu.Lock()
+	ii.hashes = nil
+	ii.mu.Unlock()
+}
+
+// hashCache computes the hash of every readable image in the cache.
+func hashCache(cache ImageCache, fn HashFunc) (map[ImageCacheKey]ImageHash, error) {
+	keys, err := cache.Keys()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[ImageCacheKey]ImageHash, len(keys))
+	for _, key := range keys {
+		m, err := cache.Get(key)
+		if err != nil {
+			continue
+		}
+		hashes[key] = fn(m)
+	}
+	return hashes, nil
+}
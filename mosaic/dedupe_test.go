@@ -0,0 +1,54 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"testing"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+func TestImageInventory_Fetch_rejectDuplicates(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	i := NewImageInventory(c)
+	i.SetFetchWorkers(1)
+	i.RejectDuplicates(DifferenceHash, 4)
+	f := &fakeSource{
+		items: []source.Item{
+			fakeItem{"/1", sceneImg(1, 120, 0)},
+			fakeItem{"/2", sceneImg(1, 120, 10)},
+			fakeItem{"/3", sceneImg(2, 120, 0)},
+		},
+	}
+	if err := i.Fetch(context.Background(), f, 2); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if !c.Has("/1") || !c.Has("/3") {
+		t.Errorf("want /1 and /3")
+	}
+	if c.Has("/2") {
+		t.Errorf("don't want /2, it's a duplicate of /1")
+	}
+}
+
+func TestImageInventory_RemoveDuplicates(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	c.Put("a", sceneImg(1, 120, 0))
+	c.Put("b", sceneImg(1, 150, 5))
+	c.Put("c", sceneImg(2, 120, 0))
+	i := NewImageInventory(c)
+	removed, err := i.RemoveDuplicates(PerceptualHash, 4)
+	if err != nil {
+		t.Fatalf("RemoveDuplicates got error %s", err)
+	}
+	if len(removed) != 1 || removed[0] != "b" {
+		t.Errorf("removed got %v, want [b]", removed)
+	}
+	if got, want := c.Size(), 2; got != want {
+		t.Errorf("Size got %d, want %d", got, want)
+	}
+}
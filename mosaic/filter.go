@@ -0,0 +1,172 @@
+package mosaic
+
+import (
+	"image"
+	"strings"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+// FilterFunc decides whether a downloaded item belongs in an inventory. It
+// returns false to reject the image. Write your own for custom rules.
+type FilterFunc func(item source.Item, m image.Image) bool
+
+// Filter makes Fetch skip images rejected by any of the filters. Videos,
+// near-monochrome images and screenshots otherwise pollute the palette.
+func (ii *ImageInventory) Filter(filters ...FilterFunc) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	ii.filters = append(ii.filters, filters...)
+}
+
+// accept returns true if no filter rejects the image.
+func (ii *ImageInventory) accept(item source.Item, m image.Image) bool {
+	ii.mu.Lock()
+	filters := ii.filters
+	ii.mu.Unlock()
+	for _, f := range filters {
+		if !f(item, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// photo is implemented by items that know if they're a photo, such as
+// Instagram media.
+type photo interface {
+	IsPhoto() bool
+}
+
+// PhotosOnly rejects items that say they aren't photos, such as the
+// thumbnails of videos. Items that don't say are accepted.
+func PhotosOnly() FilterFunc {
+	return func(item source.Item, m image.Image) bool {
+		if p, ok := item.(photo); ok {
+			return p.IsPhoto()
+		}
+		return true
+	}
+}
+
+// MinSize rejects images smaller than width by height pixels.
+func MinSize(width, height int) FilterFunc {
+	return func(item source.Item, m image.Image) bool {
+		b := m.Bounds()
+		return b.Dx() >= width && b.Dy() >= height
+	}
+}
+
+// SaturationRange rejects images whose average saturation, from 0 for gray
+// to 1 for pure color, is outside min and max. A max of zero is unlimited.
+// A min above zero rejects near-monochrome images.
+func SaturationRange(min, max float64) FilterFunc {
+	return func(item source.Item, m image.Image) bool {
+		s, _ := tone(m)
+		return inRange(s, min, max)
+	}
+}
+
+// BrightnessRange rejects images whose average brightness, from 0 for black
+// to 1 for white, is outside min and max. A max of zero is unlimited. A max
+// below one rejects mostly-white images such as screenshots of text.
+func BrightnessRange(min, max float64) FilterFunc {
+	return func(item source.Item, m image.Image) bool {
+		_, v := tone(m)
+		return inRange(v, min, max)
+	}
+}
+
+// ExcludeTags rejects items that are tagged with any of the tags, ignoring
+// case. Items without an attribution are accepted.
+func ExcludeTags(tags ...string) FilterFunc {
+	exclude := lowerSet(tags)
+	return func(item source.Item, m image.Image) bool {
+		a, ok := item.(source.Attributed)
+		if !ok {
+			return true
+		}
+		for _, t := range a.Attribution().Tags {
+			if exclude[strings.ToLower(t)] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ExcludeUsers rejects items whose author or username is any of the users,
+// ignoring case. Items without an attribution are accepted.
+func ExcludeUsers(users ...string) FilterFunc {
+	exclude := lowerSet(users)
+	return func(item source.Item, m image.Image) bool {
+		a, ok := item.(source.Attributed)
+		if !ok {
+			return true
+		}
+		attr := a.Attribution()
+		return !exclude[strings.ToLower(attr.Username)] && !exclude[strings.ToLower(attr.Author)]
+	}
+}
+
+func lowerSet(vals []string) map[string]bool {
+	set := make(map[string]bool, len(vals))
+	for _, v := range vals {
+		if v != "" {
+			set[strings.ToLower(v)] = true
+		}
+	}
+	return set
+}
+
+func inRange(v, min, max float64) bool {
+	return v >= min && (max <= 0 || v <= max)
+}
+
+// toneSamples is about how many pixels tone looks at on each axis.
+const toneSamples = 32
+
+// tone returns the average HSV saturation and value of an image, each from
+// 0 to 1.
+func tone(m image.Image) (saturation, value float64) {
+	b := m.Bounds()
+	xStep := b.Dx() / toneSamples
+	if xStep < 1 {
+		xStep = 1
+	}
+	yStep := b.Dy() / toneSamples
+	if yStep < 1 {
+		yStep = 1
+	}
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += yStep {
+		for x := b.Min.X; x < b.Max.X; x += xStep {
+			r, g, bl, _ := m.At(x, y).RGBA()
+			max := maxUint32(r, maxUint32(g, bl))
+			min := minUint32(r, minUint32(g, bl))
+			if max > 0 {
+				saturation += float64(max-min) / float64(max)
+			}
+			value += float64(max) / 0xffff
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return saturation / float64(n), value / float64(n)
+}
+
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
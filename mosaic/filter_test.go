@@ -0,0 +1,122 @@
+package mosaic
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
+)
+
+func solidImage(c color.Color, size int) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(m, m.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+	return m
+}
+
+// videoItem is a fakeItem that's not a photo.
+type videoItem struct {
+	fakeItem
+}
+
+func (v videoItem) IsPhoto() bool {
+	return false
+}
+
+// taggedItem is a fakeItem with tags and a user.
+type taggedItem struct {
+	fakeItem
+	username string
+	tags     []string
+}
+
+func (t taggedItem) Attribution() source.Attribution {
+	return source.Attribution{Username: t.username, Tags: t.tags}
+}
+
+func TestFilters(t *testing.T) {
+	red := solidImage(color.RGBA{200, 0, 0, 255}, 100)
+	gray := solidImage(color.RGBA{128, 128, 128, 255}, 100)
+	white := solidImage(color.RGBA{250, 250, 250, 255}, 100)
+	small := solidImage(color.RGBA{200, 0, 0, 255}, 10)
+	photo := fakeItem{"/1", red}
+
+	tests := []struct {
+		name   string
+		filter FilterFunc
+		item   source.Item
+		img    image.Image
+		want   bool
+	}{
+		{"photo", PhotosOnly(), photo, red, true},
+		{"video", PhotosOnly(), videoItem{photo}, red, false},
+		{"big enough", MinSize(50, 50), photo, red, true},
+		{"too small", MinSize(50, 50), photo, small, false},
+		{"saturated", SaturationRange(0.2, 0), photo, red, true},
+		{"monochrome", SaturationRange(0.2, 0), photo, gray, false},
+		{"not too bright", BrightnessRange(0, 0.9), photo, gray, true},
+		{"too bright", BrightnessRange(0, 0.9), photo, white, false},
+		{"too dark", BrightnessRange(0.6, 0), photo, gray, false},
+		{"allowed tag", ExcludeTags("Spam"), taggedItem{photo, "kitty", []string{"cat"}}, red, true},
+		{"excluded tag", ExcludeTags("Spam"), taggedItem{photo, "kitty", []string{"cat", "spam"}}, red, false},
+		{"untagged", ExcludeTags("spam"), photo, red, true},
+		{"allowed user", ExcludeUsers("bot"), taggedItem{photo, "kitty", nil}, red, true},
+		{"excluded user", ExcludeUsers("bot"), taggedItem{photo, "Bot", nil}, red, false},
+	}
+	for _, test := range tests {
+		if got := test.filter(test.item, test.img); got != test.want {
+			t.Errorf("%s got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestImageInventory_Filter(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	i := &ImageInventory{cache: c}
+	i.Filter(PhotosOnly(), func(item source.Item, m image.Image) bool {
+		return item.ID() != "/3"
+	})
+	f := &fakeSource{
+		items: []source.Item{
+			fakeThumbnailItem("/1"),
+			videoItem{fakeThumbnailItem("/2").(fakeItem)},
+			fakeThumbnailItem("/3"),
+			fakeThumbnailItem("/4"),
+		},
+	}
+	if err := i.Fetch(context.Background(), f, 5); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if got, want := c.Size(), 2; got != want {
+		t.Errorf("cache.Size() got %d, want %d", got, want)
+	}
+	for _, id := range []string{"/2", "/3"} {
+		if c.Has(c.Key(id)) {
+			t.Errorf("%s was stored, want filtered", id)
+		}
+	}
+}
+
+func TestImageInventory_Filter_noImage(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	i := &ImageInventory{cache: c}
+	i.Filter(MinSize(10, 10), SaturationRange(0.1, 1), BrightnessRange(0, 0.9))
+	f := &fakeSource{
+		items: []source.Item{
+			fakeItem{"/1", nil},
+			fakeThumbnailItem("/2"),
+		},
+	}
+	if err := i.Fetch(context.Background(), f, 5); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if c.Has(c.Key("/1")) {
+		t.Errorf("/1 was stored with no image")
+	}
+}
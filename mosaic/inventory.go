@@ -1,73 +1,191 @@
 package mosaic
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
 )
 
 // ImageInventory fetches and uses images to drive mosaic creation.
 type ImageInventory struct {
-	cache ImageCache
+	cache   ImageCache
+	workers int
+
+	// Near-duplicate rejection, see RejectDuplicates, and filters, see
+	// Filter.
+	mu          sync.Mutex
+	hashFunc    HashFunc
+	maxDistance int
+	hashes      map[ImageCacheKey]ImageHash
+	filters     []FilterFunc
 }
 
 // NewImageInventory creates an inventory using the given cache.
 func NewImageInventory(cache ImageCache) *ImageInventory {
 	return &ImageInventory{
-		cache: cache,
+		cache:   cache,
+		workers: DefaultFetchWorkers,
 	}
 }
 
+// DefaultFetchWorkers is how many images an inventory downloads at once.
+var DefaultFetchWorkers = 4
+
 // PopulatePalette pulls images from the inventory and adds them to a palette.
 func (ii *ImageInventory) PopulatePalette(palette *ImagePalette) error {
+	return ii.PopulatePaletteProgress(palette, nil)
+}
+
+// PopulatePaletteProgress is like PopulatePalette, and calls progress with
+// StagePalette as each image is added.
+func (ii *ImageInventory) PopulatePaletteProgress(palette *ImagePalette, progress ProgressFunc) error {
 	keys, err := ii.cache.Keys()
 	if err != nil {
 		return err
 	}
-	for _, key := range keys {
+	var skipped int
+	progress.report(StagePalette, 0, len(keys))
+	for n, key := range keys {
 		m, err := ii.cache.Get(key)
 		if err != nil {
-			//log.Printf("Error reading from cache: %s, key:%#v\n", err, key)
-			continue
+			skipped++
+		} else {
+			palette.AddKeyed(key, m)
 		}
-		palette.Add(m)
+		progress.report(StagePalette, n+1, len(keys))
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d of %d unreadable images, run `mosaicly cache verify`\n", skipped, len(keys))
 	}
 	return nil
 }
 
-// Fetch pulls new images from the api and adds them to the inventory.
-func (ii *ImageInventory) Fetch(fetcher instagram.Fetcher, max int) error {
-	ch, done := fetcher.Fetch()
-	defer close(done)
+// Fetch pulls new images from the source and adds them to the inventory until
+// it holds max images, the source runs out of images, or ctx is done. Images
+// are downloaded concurrently, see SetFetchWorkers.
+func (ii *ImageInventory) Fetch(ctx context.Context, src source.Source, max int) error {
+	if ii.cache.Size() >= max {
+		return nil
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := src.Items(runCtx)
 
-	var m *instagram.Media
-	var count int
-	for {
-		select {
-		case m = <-ch:
-			err := ii.cacheImage(*m)
-			if err != nil {
-				return err
-			}
-			count++
-			size := ii.cache.Size()
-			if count%20 == 0 {
-				log.Printf("Pulled %d, stored %d\n", count, size)
-			}
-			if size >= max {
-				return nil
+	run := &fetchRun{
+		ctx:       runCtx,
+		cancel:    cancel,
+		inventory: ii,
+		max:       max,
+		stored:    ii.cache.Size(),
+	}
+
+	workers := ii.workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case item, ok := <-ch:
+					if !ok {
+						// Other workers may still be
+						// downloading, the run finishes
+						// when they're done.
+						return
+					}
+					run.cacheImage(item)
+				case <-runCtx.Done():
+					return
+				}
 			}
+		}()
+	}
+	wg.Wait()
+	run.finish(src.Err())
+
+	if run.err != nil {
+		return run.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if run.filtered > 0 {
+		log.Printf("Filtered out %d images\n", run.filtered)
+	}
+	if run.stored < max {
+		log.Printf("Ran out of images, stored %d of %d\n", run.stored, max)
+	}
+	return nil
+}
+
+// SetFetchWorkers sets how many images Fetch downloads at once.
+func (ii *ImageInventory) SetFetchWorkers(n int) {
+	ii.workers = n
+}
+
+// Verify checks every image in the inventory. See VerifyCache.
+func (ii *ImageInventory) Verify(minSize int) (*CacheReport, error) {
+	return VerifyCache(ii.cache, minSize)
+}
+
+// RecordUse records that the images used from the palette, as reported by
+// its Used, were used if the cache is an AccessRecorder. Call it once the
+// mosaic is composed.
+func (ii *ImageInventory) RecordUse(p *ImagePalette) error {
+	recorder, ok := ii.cache.(AccessRecorder)
+	if !ok {
+		return nil
+	}
+	var firstErr error
+	for key := range p.Used() {
+		if err := recorder.Touch(key); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	return firstErr
+}
+
+// Repair removes the bad images found by Verify. See RepairCache.
+func (ii *ImageInventory) Repair(report *CacheReport) error {
+	return RepairCache(ii.cache, report)
+}
+
+// Prune removes images until the inventory is within the quota. See Prune.
+func (ii *ImageInventory) Prune(q Quota, policy EvictionPolicy) ([]ImageCacheKey, error) {
+	removed, err := Prune(ii.cache, q, policy)
+	ii.forgetHashes()
+	return removed, err
+}
+
+// PruneInventories removes images from inventories by tag so that each is
+// within perTag, and all together are within total. See PruneAll.
+func PruneInventories(invs map[string]*ImageInventory, perTag, total Quota, policy EvictionPolicy) (map[string][]ImageCacheKey, error) {
+	caches := make(map[string]ImageCache, len(invs))
+	for tag, ii := range invs {
+		caches[tag] = ii.cache
+	}
+	removed, err := PruneAll(caches, perTag, total, policy)
+	for _, ii := range invs {
+		ii.forgetHashes()
+	}
+	return removed, err
 }
 
 // Size returns the number of images in the inventory.
@@ -75,28 +193,113 @@ func (ii *ImageInventory) Size() int {
 	return ii.cache.Size()
 }
 
-func (ii *ImageInventory) cacheImage(media instagram.Media) error {
-	rep := media.ThumbnailImage()
-	key := ii.cache.Key(rep.URL)
-	if ii.cache.Has(key) {
-		//log.Printf("Has %s\n", rep.URL)
-		return nil
+// fetchRun tracks the progress of one call to Fetch.
+type fetchRun struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	inventory *ImageInventory
+	max       int
+
+	mu       sync.Mutex
+	pulled   int
+	stored   int
+	filtered int
+	err      error
+	once     sync.Once
+}
+
+// finish stops the workers and the fetcher, recording the first error.
+func (r *fetchRun) finish(err error) {
+	r.once.Do(func() {
+		r.err = err
+		r.cancel()
+	})
+}
+
+// cacheImage downloads the item's image and stores it, unless the run is
+// finished or the image is already stored.
+func (r *fetchRun) cacheImage(item source.Item) {
+	cache := r.inventory.cache
+	key := cache.Key(item.ID())
+	if cache.Has(key) {
+		//log.Printf("Has %s\n", item.ID())
+		r.store(key, nil, item)
+		return
 	}
-	img, err := rep.Image()
+	img, err := item.Image(r.ctx)
 	if err != nil {
+		if r.ctx.Err() != nil {
+			// Stopped while downloading.
+			return
+		}
 		log.Printf("Error getting Image %s\n", err)
-		return err
+		r.finish(err)
+		return
 	}
-	//log.Printf("Get %s\n", rep.URL)
-	if err := ii.cache.Put(key, img); err != nil {
-		return err
+	//log.Printf("Get %s\n", item.ID())
+	if img == nil {
+		// Such as an empty response, there's nothing to filter or store.
+		log.Printf("No image for %s\n", item.ID())
+		r.store(key, nil, item)
+		return
+	}
+	if !r.inventory.accept(item, img) {
+		r.mu.Lock()
+		r.filtered++
+		r.mu.Unlock()
+		img = nil
+	}
+	r.store(key, img, item)
+}
+
+// store puts the image and its attribution in the cache. Storing is
+// serialized so that no more than max images are stored. A nil image is
+// counted but not stored.
+func (r *fetchRun) store(key ImageCacheKey, img image.Image, item source.Item) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pulled++
+	if r.pulled%20 == 0 {
+		log.Printf("Pulled %d, stored %d\n", r.pulled, r.stored)
+	}
+	cache := r.inventory.cache
+	if img == nil || r.stored >= r.max || cache.Has(key) {
+		return
+	}
+	dup, err := r.inventory.isDuplicate(key, img)
+	if err != nil {
+		r.finish(err)
+		return
+	}
+	if dup {
+		return
+	}
+	// The attribution is stored first so that it's never missing for a
+	// stored image.
+	if err := storeAttribution(cache, key, item); err != nil {
+		r.finish(err)
+		return
+	}
+	if err := cache.Put(key, img); err != nil {
+		r.finish(err)
+		return
+	}
+	r.stored++
+	if r.stored >= r.max {
+		r.finish(nil)
 	}
-	return nil
 }
 
 // ImageCacheKey identifies an image in the cache.
 type ImageCacheKey string
 
+// hashKey returns the SHA1 hex digest of name, a key that is safe to use as a
+// file or object name.
+func hashKey(name string) ImageCacheKey {
+	k := sha1.Sum([]byte(name))
+	return ImageCacheKey(hex.EncodeToString(k[:]))
+}
+
 // ImageCache is the interface for any cache implementation.
 type ImageCache interface {
 	// Key returns a consistent cache key from string.
@@ -111,53 +314,227 @@ type ImageCache interface {
 	// Has returns true if an image exists at key.
 	Has(ImageCacheKey) bool
 
+	// Delete removes the image at key. It is not an error to delete an
+	// image that doesn't exist.
+	Delete(ImageCacheKey) error
+
 	// Keys returns a list of the stored keys, unordered.
 	Keys() ([]ImageCacheKey, error)
 
+	// Entries returns details about the stored images, unordered.
+	Entries() ([]CacheEntry, error)
+
 	// Size returns the number of images stores.
 	Size() int
 }
 
-// fileImageCache implements an ImageCache on the filesystem.
+// CacheEntry describes a stored image.
+type CacheEntry struct {
+	Key ImageCacheKey
+	// Bytes is the stored size of the image.
+	Bytes int64
+	// Modified is when the image was stored.
+	Modified time.Time
+	// Accessed is when the image was last used in a palette. Caches that
+	// can't track use report Modified.
+	Accessed time.Time
+}
+
+// AccessRecorder is implemented by caches that track when images are used,
+// for EvictLeastRecentlyUsed. Reads by Get aren't uses, since verifying,
+// deduping, pruning and populating a palette read every image. See
+// ImageInventory.RecordUse.
+type AccessRecorder interface {
+	// Touch records that the image at key was used.
+	Touch(ImageCacheKey) error
+}
+
+// TempRemover is implemented by caches that may leave temp files behind when
+// a write is interrupted. RepairCache and PruneAll remove them.
+type TempRemover interface {
+	// RemoveTemp deletes temp files older than age, returning how many.
+	RemoveTemp(age time.Duration) (int, error)
+}
+
+// staleTempAge is how old a temp file must be before it's removed, so that
+// writes in progress are left alone.
+const staleTempAge = time.Hour
+
+// removeStaleTemp removes the cache's stale temp files, if it's a
+// TempRemover.
+func removeStaleTemp(cache ImageCache) error {
+	tr, ok := cache.(TempRemover)
+	if !ok {
+		return nil
+	}
+	n, err := tr.RemoveTemp(staleTempAge)
+	if n > 0 {
+		log.Printf("Removed %d stale temp files\n", n)
+	}
+	return err
+}
+
+// NotCachedError is returned by ImageCache.Get when no image is stored at the
+// key.
+type NotCachedError struct {
+	Key ImageCacheKey
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("image %s is not cached", e.Key)
+}
+
+// CorruptImageError is returned by ImageCache.Get when data is stored at the
+// key but cannot be decoded.
+type CorruptImageError struct {
+	Key ImageCacheKey
+	Err error
+}
+
+func (e *CorruptImageError) Error() string {
+	return fmt.Sprintf("image %s is corrupt: %s", e.Key, e.Err)
+}
+
+// IsNotCached returns true if the error means an image is missing.
+func IsNotCached(err error) bool {
+	_, ok := err.(*NotCachedError)
+	return ok
+}
+
+// IsCorrupt returns true if the error means an image could not be decoded.
+func IsCorrupt(err error) bool {
+	_, ok := err.(*CorruptImageError)
+	return ok
+}
+
+// FileCacheOptions configures durability of a file cache.
+type FileCacheOptions struct {
+	// Sync flushes each image to disk before it becomes visible.
+	Sync bool
+	// SyncDir flushes the directory after an image becomes visible, so
+	// that the new entry survives a crash.
+	SyncDir bool
+}
+
+// fileImageCache implements an ImageCache on the filesystem. Images are
+// written to a temp file and renamed into place so that readers never see a
+// partial image.
 type fileImageCache struct {
 	Dir string
+	FileCacheOptions
+	locks *keyLocks
 }
 
 // NewFileImageCache initializes a new cache to store images on the filesystem.
 func NewFileImageCache(dir string) ImageCache {
-	return &fileImageCache{dir}
+	return NewFileImageCacheWithOptions(dir, FileCacheOptions{})
+}
+
+// NewFileImageCacheWithOptions initializes a new cache to store images on the
+// filesystem with durability options.
+func NewFileImageCacheWithOptions(dir string, opts FileCacheOptions) ImageCache {
+	return &fileImageCache{
+		Dir:              dir,
+		FileCacheOptions: opts,
+		locks:            newKeyLocks(),
+	}
 }
 
 func (c fileImageCache) Key(name string) ImageCacheKey {
-	k := sha1.Sum([]byte(name))
-	return ImageCacheKey(hex.EncodeToString(k[:]))
+	return hashKey(name)
 }
 
 func (c fileImageCache) Put(key ImageCacheKey, m image.Image) error {
-	fo, err := os.Create(c.keyToPath(key))
+	c.locks.Lock(key)
+	defer c.locks.Unlock(key)
+
+	// The temp file does not end in .jpg so it's never listed by Keys.
+	fo, err := ioutil.TempFile(c.Dir, fmt.Sprintf(".%s.*.tmp", key))
 	if err != nil {
 		return err
 	}
-	defer fo.Close()
-	if err := jpeg.Encode(fo, m, nil); err != nil {
+	tmp := fo.Name()
+	// Temp files are only readable by their owner, cache files by anyone.
+	if err := fo.Chmod(0644); err != nil {
+		fo.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := c.write(fo, m); err != nil {
+		os.Remove(tmp)
 		return err
 	}
+	if err := os.Rename(tmp, c.keyToPath(key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if c.SyncDir {
+		return syncDir(c.Dir)
+	}
 	return nil
 }
 
+// write encodes the image to an open file and closes it.
+func (c fileImageCache) write(fo *os.File, m image.Image) error {
+	if err := jpeg.Encode(fo, m, nil); err != nil {
+		fo.Close()
+		return err
+	}
+	if c.Sync {
+		if err := fo.Sync(); err != nil {
+			fo.Close()
+			return err
+		}
+	}
+	return fo.Close()
+}
+
 func (c fileImageCache) Get(key ImageCacheKey) (image.Image, error) {
+	c.locks.RLock(key)
+	defer c.locks.RUnlock(key)
+
 	fi, err := os.Open(c.keyToPath(key))
+	if os.IsNotExist(err) {
+		return nil, &NotCachedError{key}
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer fi.Close()
 	m, err := jpeg.Decode(fi)
 	if err != nil {
-		return nil, err
+		return nil, &CorruptImageError{key, err}
 	}
 	return m, nil
 }
 
+// Touch records that the image at key was used. The access is recorded
+// explicitly, filesystems are often mounted without access time updates.
+func (c fileImageCache) Touch(key ImageCacheKey) error {
+	c.locks.Lock(key)
+	defer c.locks.Unlock(key)
+
+	path := c.keyToPath(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Now(), info.ModTime())
+}
+
+func (c fileImageCache) Delete(key ImageCacheKey) error {
+	c.locks.Lock(key)
+	defer c.locks.Unlock(key)
+
+	if err := os.Remove(c.keyToPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(c.keyToAttributionPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 func (c fileImageCache) Keys() ([]ImageCacheKey, error) {
 	list, err := filepath.Glob(path.Join(c.Dir, "*.jpg"))
 	if err != nil {
@@ -170,6 +547,57 @@ func (c fileImageCache) Keys() ([]ImageCacheKey, error) {
 	return keys, nil
 }
 
+func (c fileImageCache) Entries() ([]CacheEntry, error) {
+	list, err := filepath.Glob(path.Join(c.Dir, "*.jpg"))
+	if err != nil {
+		return []CacheEntry{}, err
+	}
+	entries := make([]CacheEntry, 0, len(list))
+	for _, o := range list {
+		info, err := os.Stat(o)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return []CacheEntry{}, err
+		}
+		entries = append(entries, CacheEntry{
+			Key:      c.pathToKey(o),
+			Bytes:    info.Size(),
+			Modified: info.ModTime(),
+			Accessed: accessTime(info),
+		})
+	}
+	return entries, nil
+}
+
+// RemoveTemp deletes the temp files of writes that never finished, such as
+// when the process crashed, once they're older than age.
+func (c fileImageCache) RemoveTemp(age time.Duration) (int, error) {
+	list, err := filepath.Glob(path.Join(c.Dir, ".*.tmp"))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, o := range list {
+		info, err := os.Stat(o)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if time.Since(info.ModTime()) < age {
+			continue
+		}
+		if err := os.Remove(o); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 func (c fileImageCache) Size() int {
 	list, err := c.Keys()
 	if err == nil {
@@ -179,6 +607,9 @@ func (c fileImageCache) Size() int {
 }
 
 func (c fileImageCache) Has(key ImageCacheKey) bool {
+	c.locks.RLock(key)
+	defer c.locks.RUnlock(key)
+
 	if _, err := os.Stat(c.keyToPath(key)); os.IsNotExist(err) {
 		return false
 	}
@@ -192,3 +623,64 @@ func (c fileImageCache) keyToPath(key ImageCacheKey) string {
 func (c fileImageCache) pathToKey(path string) ImageCacheKey {
 	return ImageCacheKey(strings.Trim(filepath.Base(path), filepath.Ext(path)))
 }
+
+// syncDir flushes a directory's entries to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// keyLocks is a set of read/write locks, one per key. Locks are created on
+// demand and removed when no longer held.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[ImageCacheKey]*keyLock
+}
+
+type keyLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[ImageCacheKey]*keyLock)}
+}
+
+func (l *keyLocks) acquire(key ImageCacheKey) *keyLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyLock{}
+		l.locks[key] = k
+	}
+	k.refs++
+	return k
+}
+
+func (l *keyLocks) release(key ImageCacheKey) *keyLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := l.locks[key]
+	k.refs--
+	if k.refs == 0 {
+		delete(l.locks, key)
+	}
+	return k
+}
+
+// Lock acquires the write lock for key.
+func (l *keyLocks) Lock(key ImageCacheKey) { l.acquire(key).Lock() }
+
+// Unlock releases the write lock for key.
+func (l *keyLocks) Unlock(key ImageCacheKey) { l.release(key).Unlock() }
+
+// RLock acquires a read lock for key.
+func (l *keyLocks) RLock(key ImageCacheKey) { l.acquire(key).RLock() }
+
+// RUnlock releases a read lock for key.
+func (l *keyLocks) RUnlock(key ImageCacheKey) { l.release(key).RUnlock() }
@@ -1,16 +1,27 @@
 package mosaic
 
 import (
+	"context"
 	"fmt"
 	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
 )
 
 type fakeCache struct {
-	store      map[ImageCacheKey]image.Image
+	store map[ImageCacheKey]image.Image
+	// errorOnGet is a key that's corrupt.
 	errorOnGet ImageCacheKey
+	// failOnGet is a key that can't be read, like a network error.
+	failOnGet ImageCacheKey
+	bytes     map[ImageCacheKey]int64
+	times     map[ImageCacheKey]time.Time
 }
 
 func (c *fakeCache) Key(name string) ImageCacheKey {
@@ -22,12 +33,19 @@ func (c *fakeCache) Put(k ImageCacheKey, m image.Image) error {
 }
 func (c *fakeCache) Get(k ImageCacheKey) (image.Image, error) {
 	if c.errorOnGet == k {
-		return nil, fmt.Errorf("error by errorOnGet %s", c.errorOnGet)
+		return nil, &CorruptImageError{k, fmt.Errorf("error by errorOnGet %s", c.errorOnGet)}
+	}
+	if c.failOnGet == k {
+		return nil, fmt.Errorf("error by failOnGet %s", c.failOnGet)
 	}
 	if m, ok := c.store[k]; ok {
 		return m, nil
 	}
-	return nil, fmt.Errorf("missing %s", k)
+	return nil, &NotCachedError{k}
+}
+func (c *fakeCache) Delete(k ImageCacheKey) error {
+	delete(c.store, k)
+	return nil
 }
 func (c *fakeCache) Has(k ImageCacheKey) bool {
 	_, ok := c.store[k]
@@ -40,47 +58,67 @@ func (c *fakeCache) Keys() ([]ImageCacheKey, error) {
 	}
 	return keys, nil
 }
+func (c *fakeCache) Entries() ([]CacheEntry, error) {
+	entries := make([]CacheEntry, 0, len(c.store))
+	for k := range c.store {
+		t := c.times[k]
+		entries = append(entries, CacheEntry{k, c.bytes[k], t, t})
+	}
+	return entries, nil
+}
 func (c *fakeCache) Size() int {
 	return len(c.store)
 }
 
-type fakeFetcher struct {
-	media []*instagram.Media
+type fakeSource struct {
+	items []source.Item
+	err   error
 }
 
-func (f *fakeFetcher) Fetch() (chan *instagram.Media, chan struct{}) {
-	ch := make(chan *instagram.Media)
-	done := make(chan struct{})
+func (f *fakeSource) Items(ctx context.Context) <-chan source.Item {
+	ch := make(chan source.Item)
 	go func() {
-		for _, m := range f.media {
-			ch <- m
-		}
+		defer close(ch)
+		source.Send(ctx, ch, f.items...)
 	}()
-	return ch, done
+	return ch
 }
 
-func fakeThumbnailMedia(url string) *instagram.Media {
-	m := &instagram.Media{
-		Type:   "image",
-		Images: make(map[string]*instagram.Rep),
-	}
-	m.Images["thumbnail"] = instagram.NewFakeRep(url)
-	return m
+func (f *fakeSource) Err() error {
+	return f.err
+}
+
+// fakeItem is an image identified by a URL.
+type fakeItem struct {
+	url string
+	img image.Image
+}
+
+func (f fakeItem) ID() string {
+	return f.url
+}
+
+func (f fakeItem) Image(ctx context.Context) (image.Image, error) {
+	return f.img, nil
+}
+
+func fakeThumbnailItem(url string) source.Item {
+	return fakeItem{url, image.NewRGBA(image.Rect(0, 0, 100, 100))}
 }
 
 func TestImageInventory_Fetch(t *testing.T) {
 	c := &fakeCache{
 		store: make(map[ImageCacheKey]image.Image),
 	}
-	i := &ImageInventory{c}
-	f := &fakeFetcher{
-		media: []*instagram.Media{
-			fakeThumbnailMedia("/1"),
-			fakeThumbnailMedia("/2"),
-			fakeThumbnailMedia("/3"),
+	i := &ImageInventory{cache: c}
+	f := &fakeSource{
+		items: []source.Item{
+			fakeThumbnailItem("/1"),
+			fakeThumbnailItem("/2"),
+			fakeThumbnailItem("/3"),
 		},
 	}
-	if err := i.Fetch(f, 2); err != nil {
+	if err := i.Fetch(context.Background(), f, 2); err != nil {
 		t.Fatalf("Fetch got error %s", err)
 	}
 	if got, want := c.Size(), 2; got != want {
@@ -97,11 +135,120 @@ func TestImageInventory_Fetch(t *testing.T) {
 	}
 }
 
+func TestImageInventory_Fetch_exhausted(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	i := &ImageInventory{cache: c}
+	f := &fakeSource{
+		items: []source.Item{
+			fakeThumbnailItem("/1"),
+		},
+	}
+	if err := i.Fetch(context.Background(), f, 5); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if got, want := c.Size(), 1; got != want {
+		t.Errorf("cache.Size() got %d, want %d", got, want)
+	}
+
+	// Errors from the fetcher are returned.
+	f.err = fmt.Errorf("fetch failed")
+	if err := i.Fetch(context.Background(), f, 5); err != f.err {
+		t.Errorf("Fetch got error %v, want %v", err, f.err)
+	}
+}
+
+func TestImageInventory_Fetch_cancel(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	i := &ImageInventory{cache: c}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := i.Fetch(ctx, &fakeSource{}, 5); err != context.Canceled {
+		t.Errorf("Fetch got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestImageInventory_Fetch_concurrent(t *testing.T) {
+	c := &syncCache{fakeCache: fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}}
+	i := NewImageInventory(c)
+	i.SetFetchWorkers(8)
+	f := &fakeSource{}
+	for n := 0; n < 50; n++ {
+		f.items = append(f.items, fakeThumbnailItem(fmt.Sprintf("/%d", n)))
+	}
+	if err := i.Fetch(context.Background(), f, 10); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if got, want := c.Size(), 10; got != want {
+		t.Errorf("cache.Size() got %d, want %d", got, want)
+	}
+}
+
+// slowItem is a fakeItem that takes a while to download.
+type slowItem struct {
+	fakeItem
+}
+
+func (s slowItem) Image(ctx context.Context) (image.Image, error) {
+	select {
+	case <-time.After(20 * time.Millisecond):
+		return s.img, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestImageInventory_Fetch_exhaustedConcurrent(t *testing.T) {
+	c := &syncCache{fakeCache: fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}}
+	i := NewImageInventory(c)
+	i.SetFetchWorkers(4)
+	f := &fakeSource{}
+	for n := 0; n < 6; n++ {
+		f.items = append(f.items, slowItem{fakeThumbnailItem(fmt.Sprintf("/%d", n)).(fakeItem)})
+	}
+	// Downloads in progress when the source runs out are kept.
+	if err := i.Fetch(context.Background(), f, 10); err != nil {
+		t.Fatalf("Fetch got error %s", err)
+	}
+	if got, want := c.Size(), 6; got != want {
+		t.Errorf("cache.Size() got %d, want %d", got, want)
+	}
+}
+
+// syncCache is a fakeCache that's safe for concurrent use.
+type syncCache struct {
+	mu sync.Mutex
+	fakeCache
+}
+
+func (c *syncCache) Put(k ImageCacheKey, m image.Image) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fakeCache.Put(k, m)
+}
+func (c *syncCache) Has(k ImageCacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fakeCache.Has(k)
+}
+func (c *syncCache) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fakeCache.Size()
+}
+
 func TestImageInventory_PopulatePalette(t *testing.T) {
 	c := &fakeCache{
 		store: make(map[ImageCacheKey]image.Image),
 	}
-	i := &ImageInventory{c}
+	i := &ImageInventory{cache: c}
 	c.Put(ImageCacheKey("a"), image.NewRGBA(image.Rect(0, 0, 100, 100)))
 	c.Put(ImageCacheKey("b"), image.NewRGBA(image.Rect(0, 0, 100, 100)))
 	c.Put(ImageCacheKey("c"), image.NewRGBA(image.Rect(0, 0, 100, 100)))
@@ -117,7 +264,7 @@ func TestImageInventory_PopulatePalette(t *testing.T) {
 }
 
 func Test_fileImageCache_Key(t *testing.T) {
-	c := fileImageCache{"./images"}
+	c := fileImageCache{Dir: "./images"}
 	key := c.Key("foo.jpg")
 	want := ImageCacheKey("c1b5cbd47aa3c44f029d1140cdf1b65a591bdb2c")
 	if key != want {
@@ -126,7 +273,7 @@ func Test_fileImageCache_Key(t *testing.T) {
 }
 
 func Test_fileImageCache_pathsAndKeys(t *testing.T) {
-	c := fileImageCache{"./images"}
+	c := fileImageCache{Dir: "./images"}
 	fooKey, fooPath := "foo", "./images/foo.jpg"
 	path := c.keyToPath(ImageCacheKey("foo"))
 	if path != fooPath {
@@ -137,3 +284,171 @@ func Test_fileImageCache_pathsAndKeys(t *testing.T) {
 		t.Errorf("pathToKey got %s, want %s", key, fooKey)
 	}
 }
+
+func Test_fileImageCache_PutGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewFileImageCacheWithOptions(dir, FileCacheOptions{Sync: true, SyncDir: true})
+
+	key := c.Key("foo")
+	if err := c.Put(key, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("Put got error %s", err)
+	}
+	if _, err := c.Get(key); err != nil {
+		t.Errorf("Get got error %s", err)
+	}
+
+	// No temp files are left behind.
+	files, _ := ioutil.ReadDir(dir)
+	if got, want := len(files), 1; got != want {
+		t.Errorf("got %d files, want %d", got, want)
+	}
+
+	// Missing and corrupt images are distinguished.
+	if _, err := c.Get(c.Key("missing")); !IsNotCached(err) {
+		t.Errorf("Get missing got %v, want NotCachedError", err)
+	}
+	bad := c.Key("bad")
+	ioutil.WriteFile(filepath.Join(dir, string(bad)+".jpg"), []byte("nope"), 0644)
+	if _, err := c.Get(bad); !IsCorrupt(err) {
+		t.Errorf("Get corrupt got %v, want CorruptImageError", err)
+	}
+}
+
+func Test_fileImageCache_Touch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewFileImageCache(dir)
+	key := c.Key("foo")
+	if err := c.Put(key, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	path := filepath.Join(dir, string(key)+".jpg")
+	if err := os.Chtimes(path, then, then.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	accessed := func() time.Time {
+		entries, err := c.Entries()
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Entries got %v, %v", entries, err)
+		}
+		return entries[0].Accessed
+	}
+
+	// Reading isn't a use, nor is adding it to a palette. Read the file
+	// first, so that relatime has updated the access time once for the
+	// change above.
+	if _, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	read := accessed()
+	if _, err := c.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if got := accessed(); !got.Equal(read) {
+		t.Errorf("Get changed Accessed to %v, want %v", got, read)
+	}
+	inv := NewImageInventory(c)
+	p := NewImagePalette(4)
+	if err := inv.PopulatePalette(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := accessed(); !got.Equal(read) {
+		t.Errorf("PopulatePalette changed Accessed to %v, want %v", got, read)
+	}
+
+	// Using it in a mosaic is.
+	ComposeSquare(image.NewRGBA(image.Rect(0, 0, 10, 10)), 1, 10, p)
+	if err := inv.RecordUse(p); err != nil {
+		t.Fatal(err)
+	}
+	if got := accessed(); !got.After(read) {
+		t.Errorf("RecordUse left Accessed at %v", got)
+	}
+}
+
+func Test_fileImageCache_temp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewFileImageCache(dir)
+	key := c.Key("foo")
+	if err := c.Put(key, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, string(key)+".jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0644); got != want {
+		t.Errorf("mode got %s, want %s", got, want)
+	}
+
+	// Temp files left by interrupted writes aren't entries, and are
+	// removed once they're stale.
+	stale := filepath.Join(dir, ".bar.123.tmp")
+	fresh := filepath.Join(dir, ".baz.456.tmp")
+	for _, p := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(p, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	then := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(stale, then, then); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := c.Keys(); err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("Keys got %v, %v", keys, err)
+	}
+	if entries, err := c.Entries(); err != nil || len(entries) != 1 || entries[0].Key != key {
+		t.Errorf("Entries got %v, %v", entries, err)
+	}
+	if _, err := Prune(c, Quota{MaxEntries: 10}, EvictOldest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale temp file got %v, want removed", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temp file got %v, want kept", err)
+	}
+}
+
+func Test_fileImageCache_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewFileImageCache(dir)
+	key := c.Key("foo")
+	m := image.NewRGBA(image.Rect(0, 0, 50, 50))
+
+	// Readers only ever see a complete image or no image at all.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := c.Put(key, m); err != nil {
+				t.Errorf("Put got error %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get(key); err != nil && !IsNotCached(err) {
+				t.Errorf("Get got error %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -1,6 +1,7 @@
 package mosaic
 
 import (
+	"context"
 	"image"
 	"image/color"
 	"image/draw"
@@ -11,17 +12,58 @@ import (
 // ComposeSquare returns a new composite mosaic image from the input source. It
 // operates simply on square images and square thumbnails.
 func ComposeSquare(in image.Image, units, thumbSize int, p *ImagePalette) image.Image {
-	sq := cropSquare(in)
-	m := Mosaic{units, units, thumbSize, thumbSize, sq}
-	return m.Compose(p)
+	return NewSquareMosaic(in, units, thumbSize).Compose(p)
+}
+
+// ComposeFit returns a new composite mosaic image from the input source,
+// keeping its aspect ratio. The longer side is units wide and the shorter side
+// is scaled to match, using square thumbnails.
+func ComposeFit(in image.Image, units, thumbSize int, p *ImagePalette) image.Image {
+	return NewFitMosaic(in, units, thumbSize).Compose(p)
+}
+
+// fitUnits returns the grid of units whose longer side is units long and has
+// the same shape as bounds.
+func fitUnits(bounds image.Rectangle, units int) (int, int) {
+	x, y := bounds.Dx(), bounds.Dy()
+	if x == 0 || y == 0 {
+		return units, units
+	}
+	scale := func(short, long int) int {
+		n := int(math.Floor(float64(units)*float64(short)/float64(long) + 0.5))
+		if n < 1 {
+			return 1
+		}
+		return n
+	}
+	if x >= y {
+		return units, scale(y, x)
+	}
+	return scale(x, y), units
 }
 
 // Compose returns a new composite mosaic image from the input source. The output
 // image size is determined by the number of units and the size of images in
 // the palette - (ux * tx) x (uy * ty).
 func Compose(in image.Image, ux, uy, tx, ty int, p *ImagePalette) image.Image {
-	m := Mosaic{ux, uy, tx, ty, in}
-	return m.Compose(p)
+	return NewMosaic(in, ux, uy, tx, ty).Compose(p)
+}
+
+// NewMosaic returns a Mosaic of the input source, ux x uy units of tx x ty
+// pixels. Use it instead of Compose to set Progress.
+func NewMosaic(in image.Image, ux, uy, tx, ty int) Mosaic {
+	return Mosaic{UnitsX: ux, UnitsY: uy, ThumbX: tx, ThumbY: ty, img: in}
+}
+
+// NewSquareMosaic returns a Mosaic like ComposeSquare.
+func NewSquareMosaic(in image.Image, units, thumbSize int) Mosaic {
+	return NewMosaic(cropSquare(in), units, units, thumbSize, thumbSize)
+}
+
+// NewFitMosaic returns a Mosaic like ComposeFit.
+func NewFitMosaic(in image.Image, units, thumbSize int) Mosaic {
+	ux, uy := fitUnits(in.Bounds(), units)
+	return NewMosaic(in, ux, uy, thumbSize, thumbSize)
 }
 
 // Shrink is a quick way to reduce an image by a percentage.
@@ -50,6 +92,8 @@ type Mosaic struct {
 	ThumbX int
 	// ThumbY is the height of each unit, in pixels.
 	ThumbY int
+	// Progress, if set, is called with StageCompose as each row is drawn.
+	Progress ProgressFunc
 
 	img image.Image
 }
@@ -65,6 +109,13 @@ func (m Mosaic) Dither(p color.Palette) image.Image {
 // Compose generates a new image, a composite of images from ImagePalette. The
 // image's dimensinos are (UnitsX * Palette.ImgX) x (UnitsY * Palette.ImgY).
 func (m Mosaic) Compose(p *ImagePalette) image.Image {
+	out, _ := m.ComposeContext(context.Background(), p)
+	return out
+}
+
+// ComposeContext is like Compose, but stops with ctx's error if it's done
+// before the image is finished.
+func (m Mosaic) ComposeContext(ctx context.Context, p *ImagePalette) (image.Image, error) {
 	// Create the dither pattern image.
 	d := m.Dither(p.Palette)
 	db := d.Bounds()
@@ -74,7 +125,11 @@ func (m Mosaic) Compose(p *ImagePalette) image.Image {
 
 	// Iterate over the dither pattern and pull an image from the palette,
 	// then draw it onto the output at its size.
+	m.Progress.report(StageCompose, 0, db.Dy())
 	for y := db.Min.Y; y < db.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		for x := db.Min.X; x < db.Max.X; x++ {
 			c := d.At(x, y)
 			t := p.AtColor(c)
@@ -87,8 +142,9 @@ func (m Mosaic) Compose(p *ImagePalette) image.Image {
 			//fmt.Printf("Draw %d,%d %v\n", x, y, rect)
 			draw.Draw(out, rect, t, image.ZP, draw.Src)
 		}
+		m.Progress.report(StageCompose, y-db.Min.Y+1, db.Dy())
 	}
-	return out
+	return out, nil
 }
 
 func cropSquare(in image.Image) image.Image {
@@ -107,6 +163,42 @@ func dither(in image.Image, p color.Palette) image.Image {
 	return o
 }
 
+// Resize scales an image to width by height, averaging the pixels that each
+// output pixel covers. Unlike Shrink, all of the input is used whatever the
+// ratio of the sizes.
+func Resize(in image.Image, width, height int) image.Image {
+	ib := in.Bounds()
+	log.Printf("Resize: input %dx%d, output %dx%d", ib.Dx(), ib.Dy(), width, height)
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	// span returns the input pixels covered by output pixel i of n.
+	var span = func(i, n, min, size int) (int, int) {
+		a, b := min+i*size/n, min+(i+1)*size/n
+		if b == a {
+			b = a + 1
+		}
+		return a, b
+	}
+	for y := 0; y < height; y++ {
+		y0, y1 := span(y, height, ib.Min.Y, ib.Dy())
+		for x := 0; x < width; x++ {
+			x0, x1 := span(x, width, ib.Min.X, ib.Dx())
+			var r, g, b, a, c uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := in.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					c++
+				}
+			}
+			out.Set(x, y, color.RGBA64{uint16(r / c), uint16(g / c), uint16(b / c), uint16(a / c)})
+		}
+	}
+	return out
+}
+
 // downsample reduces an image size.
 func downsample(in image.Image, dx, dy int, samplePixels, sampleRadius float64) image.Image {
 	// Calculate pixels size of each block in the input.
@@ -1,6 +1,7 @@
 package mosaic
 
 import (
+	"context"
 	"image"
 	"image/color"
 	"image/color/palette"
@@ -21,6 +22,29 @@ func TestComposeSquare(t *testing.T) {
 	}
 }
 
+func TestComposeFit(t *testing.T) {
+	pal := NewSolidPalette(palette.WebSafe)
+	for _, test := range []struct {
+		w, h   int
+		dx, dy int
+	}{
+		{100, 200, 250, 500},
+		{300, 100, 500, 150},
+		{100, 100, 500, 500},
+		{1000, 10, 500, 50},
+	} {
+		in := image.NewRGBA(image.Rect(0, 0, test.w, test.h))
+		// The longer side is units * unit size, the other keeps the shape.
+		m := ComposeFit(in, 10, 50, pal)
+		if got, want := m.Bounds().Dx(), test.dx; got != want {
+			t.Errorf("%dx%d Dx got %d, want %d", test.w, test.h, got, want)
+		}
+		if got, want := m.Bounds().Dy(), test.dy; got != want {
+			t.Errorf("%dx%d Dy got %d, want %d", test.w, test.h, got, want)
+		}
+	}
+}
+
 func TestCompose(t *testing.T) {
 	// Non-square image bounds have unspecified behavior right now.
 	in := image.NewRGBA(image.Rect(0, 0, 100, 200))
@@ -63,7 +87,7 @@ func TestMosiac_Dither(t *testing.T) {
 
 func TestMosiac_Compose(t *testing.T) {
 	in := solidImg(image.Rect(0, 0, 500, 500), color.White)
-	mos := Mosaic{10, 10, 10, 10, in}
+	mos := NewMosaic(in, 10, 10, 10, 10)
 	pal := NewSolidPalette(palette.WebSafe)
 	out := mos.Compose(pal)
 	if got, want := out.Bounds().Dx(), 100; got != want {
@@ -74,6 +98,47 @@ func TestMosiac_Compose(t *testing.T) {
 	}
 }
 
+func TestMosiac_Compose_progress(t *testing.T) {
+	in := solidImg(image.Rect(0, 0, 500, 500), color.White)
+	mos := NewMosaic(in, 10, 4, 10, 10)
+	var calls [][2]int
+	mos.Progress = func(stage string, done, total int) {
+		if stage != StageCompose {
+			t.Errorf("stage got %s, want %s", stage, StageCompose)
+		}
+		calls = append(calls, [2]int{done, total})
+	}
+	mos.Compose(NewSolidPalette(palette.WebSafe))
+	// Reports once to start, then after each row.
+	if got, want := len(calls), 5; got != want {
+		t.Fatalf("progress calls got %d, want %d", got, want)
+	}
+	for n, c := range calls {
+		if c != [2]int{n, 4} {
+			t.Errorf("call %d got %v, want [%d 4]", n, c, n)
+		}
+	}
+}
+
+func TestMosiac_ComposeContext(t *testing.T) {
+	in := solidImg(image.Rect(0, 0, 500, 500), color.White)
+	mos := NewMosaic(in, 10, 10, 10, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel part way through.
+	mos.Progress = func(stage string, done, total int) {
+		if done == 3 {
+			cancel()
+		}
+	}
+	out, err := mos.ComposeContext(ctx, NewSolidPalette(palette.WebSafe))
+	if err != context.Canceled {
+		t.Errorf("err got %v, want context.Canceled", err)
+	}
+	if out != nil {
+		t.Errorf("want no image when cancelled")
+	}
+}
+
 func Test_dither(t *testing.T) {
 	m := solidImg(image.Rect(0, 0, 100, 100), color.White)
 	o := dither(m, palette.WebSafe)
@@ -82,6 +147,37 @@ func Test_dither(t *testing.T) {
 	}
 }
 
+func TestResize(t *testing.T) {
+	// The left half is red and the right half is blue, offset from the
+	// origin like a cropped image.
+	in := image.NewRGBA(image.Rect(10, 10, 310, 110))
+	for x := 10; x < 310; x++ {
+		for y := 10; y < 110; y++ {
+			if x < 160 {
+				in.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				in.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	out := Resize(in, 7, 3)
+	if got, want := out.Bounds(), image.Rect(0, 0, 7, 3); got != want {
+		t.Fatalf("bounds got %v, want %v", got, want)
+	}
+	for x, want := range map[int]color.RGBA{
+		0: {255, 0, 0, 255},
+		6: {0, 0, 255, 255},
+	} {
+		if got := color.RGBAModel.Convert(out.At(x, 1)); got != want {
+			t.Errorf("At(%d, 1) got %v, want %v", x, got, want)
+		}
+	}
+	// The middle pixel covers both halves.
+	if got := color.RGBAModel.Convert(out.At(3, 1)).(color.RGBA); got.R == 0 || got.B == 0 {
+		t.Errorf("At(3, 1) got %v, want a blend", got)
+	}
+}
+
 func Test_downsample(t *testing.T) {
 	c := color.RGBA{100, 120, 140, 255}
 	m := solidImg(image.Rect(0, 0, 500, 500), c)
@@ -12,7 +12,9 @@ type ImagePalette struct {
 	color.Palette
 	solidFallback bool
 	images        map[int][]image.Image
+	keys          map[int][]ImageCacheKey
 	indices       map[int]int
+	used          map[ImageCacheKey]int
 }
 
 // NewImagePalette initializes an ImagePalette of a number of colors, and
@@ -23,7 +25,9 @@ func NewImagePalette(colors int) *ImagePalette {
 		Palette:       make(color.Palette, 0, colors),
 		solidFallback: false,
 		images:        make(map[int][]image.Image),
+		keys:          make(map[int][]ImageCacheKey),
 		indices:       make(map[int]int),
+		used:          make(map[ImageCacheKey]int),
 	}
 }
 
@@ -41,6 +45,12 @@ func NewSolidPalette(palette color.Palette) *ImagePalette {
 // If the palette is full, or the palette already contains the color of the
 // image then the image is added as an option to the nearest color.
 func (p *ImagePalette) Add(m image.Image) {
+	p.AddKeyed("", m)
+}
+
+// AddKeyed adds an image like Add, remembering the cache key it came from so
+// that its use can be reported by Used.
+func (p *ImagePalette) AddKeyed(key ImageCacheKey, m image.Image) {
 	c := average(m, m.Bounds(), 1)
 	// If we don't have a full color palette, use every image as a new
 	// entry (unless it's a dup).
@@ -63,6 +73,7 @@ func (p *ImagePalette) Add(m image.Image) {
 	i := p.Index(c)
 	// TODO: crop image to ImgX, ImgY
 	p.images[i] = append(p.images[i], m)
+	p.keys[i] = append(p.keys[i], key)
 	//fmt.Printf("Add(%v) %d\n", c, len(p.images[i]))
 }
 
@@ -78,6 +89,9 @@ func (p *ImagePalette) AtColor(c color.Color) image.Image {
 			idx = 0
 		}
 		//fmt.Printf("%v %d is %v\n", c, idx, images[idx].At(0, 0))
+		if key := p.keys[i][idx]; key != "" {
+			p.used[key]++
+		}
 		return images[idx]
 	}
 	if p.solidFallback {
@@ -87,6 +101,15 @@ func (p *ImagePalette) AtColor(c color.Color) image.Image {
 	return nil
 }
 
+// Used returns how many times each keyed image has been returned by AtColor.
+func (p *ImagePalette) Used() map[ImageCacheKey]int {
+	used := make(map[ImageCacheKey]int, len(p.used))
+	for k, n := range p.used {
+		used[k] = n
+	}
+	return used
+}
+
 // NumColors returns the number of colors in the palette.
 func (p *ImagePalette) NumColors() int {
 	return len(p.Palette)
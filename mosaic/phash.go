@@ -0,0 +1,136 @@
+package mosaic
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// ImageHash is a 64 bit perceptual fingerprint of an image. Similar images
+// have hashes that differ in few bits.
+type ImageHash uint64
+
+// Distance returns the hamming distance between two hashes.
+func (h ImageHash) Distance(o ImageHash) int {
+	return bits.OnesCount64(uint64(h ^ o))
+}
+
+// HashFunc computes the ImageHash of an image.
+type HashFunc func(image.Image) ImageHash
+
+// HashFuncs are the available hash algorithms by name.
+var HashFuncs = map[string]HashFunc{
+	"ahash": AverageHash,
+	"dhash": DifferenceHash,
+	"phash": PerceptualHash,
+}
+
+// AverageHash sets each bit by whether a pixel of the 8x8 grayscale image is
+// brighter than the mean. It's fast, but sensitive to changes in brightness.
+func AverageHash(m image.Image) ImageHash {
+	px := grayscale(m, 8, 8)
+	var mean float64
+	for _, v := range px {
+		mean += v
+	}
+	mean /= float64(len(px))
+	var h ImageHash
+	for i, v := range px {
+		if v > mean {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// DifferenceHash sets each bit by whether a pixel of the 9x8 grayscale image
+// is brighter than its neighbor to the right. It tracks gradients, so it
+// survives changes in brightness and contrast.
+func DifferenceHash(m image.Image) ImageHash {
+	px := grayscale(m, 9, 8)
+	var h ImageHash
+	var i uint
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if px[y*9+x] > px[y*9+x+1] {
+				h |= 1 << i
+			}
+			i++
+		}
+	}
+	return h
+}
+
+// PerceptualHash sets each bit by whether a low frequency DCT coefficient of
+// the 32x32 grayscale image is above the median. It's the slowest, and the
+// most robust to crops, scaling and recompression.
+func PerceptualHash(m image.Image) ImageHash {
+	const size, keep = 32, 8
+	px := grayscale(m, size, size)
+
+	// Two dimensional DCT-II, keeping only the top left coefficients.
+	var cos [keep][size]float64
+	for u := 0; u < keep; u++ {
+		for x := 0; x < size; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+	coeffs := make([]float64, 0, keep*keep)
+	for v := 0; v < keep; v++ {
+		for u := 0; u < keep; u++ {
+			var sum float64
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += px[y*size+x] * cos[u][x] * cos[v][y]
+				}
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// The first coefficient is the average color, leave it out of the
+	// median so that it doesn't skew the result.
+	sorted := make([]float64, len(coeffs)-1)
+	copy(sorted, coeffs[1:])
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var h ImageHash
+	for i, c := range coeffs {
+		if c > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// grayscale reduces an image to w x h luminance values, row by row, by
+// averaging the pixels of each block.
+func grayscale(m image.Image, w, h int) []float64 {
+	b := m.Bounds()
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := b.Min.Y + (y+1)*b.Dy()/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := b.Min.X + (x+1)*b.Dx()/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			for py := y0; py < y1; py++ {
+				for px := x0; px < x1; px++ {
+					r, g, b, _ := m.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			out[y*w+x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+	return out
+}
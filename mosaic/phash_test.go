@@ -0,0 +1,50 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// sceneImg draws a deterministic pattern of gray blocks from seed, scaled to
+// size and brightened. The same seed gives a similar image at any size.
+func sceneImg(seed uint32, size int, brighten uint8) image.Image {
+	const blocks = 6
+	var vals [blocks * blocks]uint8
+	for i := range vals {
+		seed = seed*1664525 + 1013904223
+		vals[i] = uint8(seed>>24) / 2
+	}
+	m := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := vals[(y*blocks/size)*blocks+x*blocks/size] + brighten
+			m.Set(x, y, color.RGBA{c, c, c, 255})
+		}
+	}
+	return m
+}
+
+func TestHashFuncs(t *testing.T) {
+	orig := sceneImg(1, 120, 0)
+	similar := sceneImg(1, 150, 20)
+	different := sceneImg(2, 120, 0)
+	for name, fn := range HashFuncs {
+		h := fn(orig)
+		if got := h.Distance(fn(orig)); got != 0 {
+			t.Errorf("%s same image got distance %d, want 0", name, got)
+		}
+		if got := h.Distance(fn(similar)); got > 5 {
+			t.Errorf("%s similar image got distance %d, want <= 5", name, got)
+		}
+		if got := h.Distance(fn(different)); got < 20 {
+			t.Errorf("%s different image got distance %d, want >= 20", name, got)
+		}
+	}
+}
+
+func TestImageHash_Distance(t *testing.T) {
+	if got, want := ImageHash(0xF0).Distance(ImageHash(0x0F)), 8; got != want {
+		t.Errorf("Distance got %d, want %d", got, want)
+	}
+}
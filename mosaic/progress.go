@@ -0,0 +1,22 @@
+package mosaic
+
+// Stages of generating a mosaic, reported to a ProgressFunc.
+const (
+	// StagePalette is adding images to the palette.
+	StagePalette = "palette"
+	// StageCompose is drawing the rows of the mosaic.
+	StageCompose = "compose"
+	// StageEncode is writing out the finished image.
+	StageEncode = "encode"
+)
+
+// ProgressFunc is called as work is done, with how many of the total steps
+// of a stage are complete.
+type ProgressFunc func(stage string, done, total int)
+
+// report calls f, if it's set.
+func (f ProgressFunc) report(stage string, done, total int) {
+	if f != nil {
+		f(stage, done, total)
+	}
+}
@@ -0,0 +1,213 @@
+package mosaic
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+)
+
+// Quota limits the size of a cache. Zero values are unlimited.
+type Quota struct {
+	// MaxEntries is the most images to keep.
+	MaxEntries int
+	// MaxBytes is the most stored bytes to keep.
+	MaxBytes int64
+}
+
+func (q Quota) exceeded(entries int, bytes int64) bool {
+	return (q.MaxEntries > 0 && entries > q.MaxEntries) ||
+		(q.MaxBytes > 0 && bytes > q.MaxBytes)
+}
+
+// EvictionPolicy decides which images are removed first when a cache is over
+// quota.
+type EvictionPolicy string
+
+const (
+	// EvictOldest removes the images that were stored first.
+	EvictOldest EvictionPolicy = "age"
+	// EvictLeastRecentlyUsed removes the images that were used in a mosaic
+	// longest ago. See ImageInventory.RecordUse.
+	EvictLeastRecentlyUsed EvictionPolicy = "lru"
+	// EvictLeastUseful removes images from the most crowded palette colors
+	// first, preserving color coverage.
+	EvictLeastUseful EvictionPolicy = "coverage"
+)
+
+// ParseEvictionPolicy returns the policy by name.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(name); p {
+	case EvictOldest, EvictLeastRecentlyUsed, EvictLeastUseful:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// coveragePaletteSize is the number of palette colors considered by
+// EvictLeastUseful. It matches the palette used to generate mosaics.
+var coveragePaletteSize = 256
+
+// evictionCandidate is an image that may be removed. Candidates with lower
+// rank are removed first.
+type evictionCandidate struct {
+	CacheEntry
+	cache ImageCache
+	tag   string
+	rank  float64
+}
+
+// Prune removes images from the cache until it's within the quota, in the
+// order determined by policy. It returns the keys that were removed.
+func Prune(cache ImageCache, q Quota, policy EvictionPolicy) ([]ImageCacheKey, error) {
+	removed, err := PruneAll(map[string]ImageCache{"": cache}, q, Quota{}, policy)
+	return removed[""], err
+}
+
+// PruneAll removes images from a set of caches by tag so that each is within
+// perTag, and all together are within total. It returns the keys that were
+// removed by tag. Stale temp files are removed too.
+func PruneAll(caches map[string]ImageCache, perTag, total Quota, policy EvictionPolicy) (map[string][]ImageCacheKey, error) {
+	removed := make(map[string][]ImageCacheKey)
+	remaining := []evictionCandidate{}
+	for tag, cache := range caches {
+		if err := removeStaleTemp(cache); err != nil {
+			return removed, err
+		}
+		candidates, err := rankEntries(cache, policy)
+		if err != nil {
+			return removed, err
+		}
+		for i := range candidates {
+			candidates[i].tag = tag
+		}
+		rest, err := evict(candidates, perTag, removed)
+		if err != nil {
+			return removed, err
+		}
+		remaining = append(remaining, rest...)
+	}
+	sortCandidates(remaining)
+	_, err := evict(remaining, total, removed)
+	return removed, err
+}
+
+// evict deletes candidates in order until the rest are within the quota. It
+// records deleted keys in removed and returns the candidates that remain.
+func evict(candidates []evictionCandidate, q Quota, removed map[string][]ImageCacheKey) ([]evictionCandidate, error) {
+	var bytes int64
+	for _, c := range candidates {
+		bytes += c.Bytes
+	}
+	for len(candidates) > 0 && q.exceeded(len(candidates), bytes) {
+		c := candidates[0]
+		if err := c.cache.Delete(c.Key); err != nil {
+			return candidates, err
+		}
+		removed[c.tag] = append(removed[c.tag], c.Key)
+		bytes -= c.Bytes
+		candidates = candidates[1:]
+	}
+	return candidates, nil
+}
+
+// rankEntries returns the entries in a cache ordered for eviction.
+func rankEntries(cache ImageCache, policy EvictionPolicy) ([]evictionCandidate, error) {
+	entries, err := cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]evictionCandidate, len(entries))
+	for i, e := range entries {
+		candidates[i] = evictionCandidate{CacheEntry: e, cache: cache}
+	}
+	switch policy {
+	case EvictOldest:
+		for i := range candidates {
+			candidates[i].rank = float64(candidates[i].Modified.UnixNano())
+		}
+	case EvictLeastRecentlyUsed:
+		for i := range candidates {
+			candidates[i].rank = float64(candidates[i].Accessed.UnixNano())
+		}
+	case EvictLeastUseful:
+		if err := rankByCoverage(cache, candidates); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", policy)
+	}
+	sortCandidates(candidates)
+	return candidates, nil
+}
+
+// rankByCoverage groups images by their nearest palette color, the same way
+// ImagePalette does, then ranks images in the most crowded colors lowest. The
+// last image of each color is ranked highest so that colors are lost last.
+func rankByCoverage(cache ImageCache, candidates []evictionCandidate) error {
+	colors := make([]color.Color, len(candidates))
+	p := make(color.Palette, 0, coveragePaletteSize)
+	for i, c := range candidates {
+		m, err := cache.Get(c.Key)
+		if err != nil {
+			// Unreadable images are the least useful of all.
+			colors[i] = nil
+			continue
+		}
+		colors[i] = average(m, m.Bounds(), 1)
+		if len(p) < cap(p) && !paletteHas(p, colors[i]) {
+			p = append(p, colors[i])
+		}
+	}
+
+	// Bucket candidates by palette index, oldest first.
+	buckets := make(map[int][]int)
+	for i, c := range colors {
+		if c == nil {
+			candidates[i].rank = -float64(len(candidates) + 1)
+			continue
+		}
+		idx := p.Index(c)
+		buckets[idx] = append(buckets[idx], i)
+	}
+	for _, b := range buckets {
+		sort.Slice(b, func(x, y int) bool {
+			return candidates[b[x]].Modified.Before(candidates[b[y]].Modified)
+		})
+	}
+
+	// Repeatedly take the oldest image from the most crowded color.
+	for {
+		most := -1
+		for idx, b := range buckets {
+			if len(b) > 1 && (most == -1 || len(b) > len(buckets[most]) || (len(b) == len(buckets[most]) && idx < most)) {
+				most = idx
+			}
+		}
+		if most == -1 {
+			break
+		}
+		b := buckets[most]
+		candidates[b[0]].rank = -float64(len(b))
+		buckets[most] = b[1:]
+	}
+	return nil
+}
+
+func paletteHas(p color.Palette, c color.Color) bool {
+	for _, x := range p {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+// sortCandidates orders candidates by rank, then by age.
+func sortCandidates(candidates []evictionCandidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].Modified.Before(candidates[j].Modified)
+	})
+}
@@ -0,0 +1,161 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPruneCache() *fakeCache {
+	return &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+		bytes: make(map[ImageCacheKey]int64),
+		times: make(map[ImageCacheKey]time.Time),
+	}
+}
+
+func (c *fakeCache) putAt(k ImageCacheKey, m image.Image, bytes int64, day int) {
+	c.Put(k, m)
+	c.bytes[k] = bytes
+	c.times[k] = time.Date(2015, 5, day, 0, 0, 0, 0, time.UTC)
+}
+
+func sortedKeys(keys []ImageCacheKey) string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = string(k)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestPrune_age(t *testing.T) {
+	c := newPruneCache()
+	box := image.Rect(0, 0, 10, 10)
+	c.putAt("c", solidImg(box, color.White), 100, 3)
+	c.putAt("a", solidImg(box, color.White), 100, 1)
+	c.putAt("b", solidImg(box, color.White), 100, 2)
+
+	removed, err := Prune(c, Quota{MaxEntries: 5, MaxBytes: 150}, EvictOldest)
+	if err != nil {
+		t.Fatalf("Prune got error %s", err)
+	}
+	if got, want := sortedKeys(removed), "a,b"; got != want {
+		t.Errorf("removed got %s, want %s", got, want)
+	}
+	if !c.Has("c") {
+		t.Errorf("want newest image kept")
+	}
+}
+
+func TestPrune_leastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewFileImageCache(dir)
+	box := image.Rect(0, 0, 10, 10)
+	colors := map[string]color.Color{
+		"red":   color.RGBA{255, 0, 0, 255},
+		"green": color.RGBA{0, 255, 0, 255},
+		"blue":  color.RGBA{0, 0, 255, 255},
+		"white": color.White,
+	}
+	names := make(map[ImageCacheKey]string)
+	for name, col := range colors {
+		key := c.Key(name)
+		names[key] = name
+		if err := c.Put(key, solidImg(box, col)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A mosaic of red and green uses only those.
+	inv := NewImageInventory(c)
+	p := NewImagePalette(16)
+	if err := inv.PopulatePalette(p); err != nil {
+		t.Fatal(err)
+	}
+	in := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(in, image.Rect(0, 0, 10, 10), image.NewUniform(colors["red"]), image.ZP, draw.Src)
+	draw.Draw(in, image.Rect(10, 0, 20, 10), image.NewUniform(colors["green"]), image.ZP, draw.Src)
+	ComposeFit(in, 2, 10, p)
+
+	// Until their use is recorded, red and green were read longest ago.
+	now := time.Now()
+	for key, name := range names {
+		at := now.Add(-time.Hour)
+		if name == "red" || name == "green" {
+			at = now.Add(-2 * time.Hour)
+		}
+		if err := os.Chtimes(filepath.Join(dir, string(key)+".jpg"), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := inv.RecordUse(p); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := Prune(c, Quota{MaxEntries: 2}, EvictLeastRecentlyUsed)
+	if err != nil {
+		t.Fatalf("Prune got error %s", err)
+	}
+	got := make([]ImageCacheKey, len(removed))
+	for i, key := range removed {
+		got[i] = ImageCacheKey(names[key])
+	}
+	if got, want := sortedKeys(got), "blue,white"; got != want {
+		t.Errorf("removed got %s, want %s", got, want)
+	}
+}
+
+func TestPrune_coverage(t *testing.T) {
+	c := newPruneCache()
+	box := image.Rect(0, 0, 10, 10)
+	// Three whites crowd one color, red and blue are unique.
+	c.putAt("w1", solidImg(box, color.White), 1, 1)
+	c.putAt("w2", solidImg(box, color.White), 1, 2)
+	c.putAt("w3", solidImg(box, color.White), 1, 3)
+	c.putAt("red", solidImg(box, color.RGBA{255, 0, 0, 255}), 1, 1)
+	c.putAt("blue", solidImg(box, color.RGBA{0, 0, 255, 255}), 1, 1)
+
+	removed, err := Prune(c, Quota{MaxEntries: 3}, EvictLeastUseful)
+	if err != nil {
+		t.Fatalf("Prune got error %s", err)
+	}
+	if got, want := sortedKeys(removed), "w1,w2"; got != want {
+		t.Errorf("removed got %s, want %s", got, want)
+	}
+}
+
+func TestPruneAll(t *testing.T) {
+	cats, dogs := newPruneCache(), newPruneCache()
+	box := image.Rect(0, 0, 10, 10)
+	for i, k := range []ImageCacheKey{"c1", "c2", "c3"} {
+		cats.putAt(k, solidImg(box, color.White), 1, 10+i)
+	}
+	for i, k := range []ImageCacheKey{"d1", "d2"} {
+		dogs.putAt(k, solidImg(box, color.White), 1, 1+i)
+	}
+	caches := map[string]ImageCache{"cat": cats, "dog": dogs}
+
+	// Cats are cut to 2 by the tag quota, then the oldest overall go.
+	removed, err := PruneAll(caches, Quota{MaxEntries: 2}, Quota{MaxEntries: 2}, EvictOldest)
+	if err != nil {
+		t.Fatalf("PruneAll got error %s", err)
+	}
+	if got, want := sortedKeys(removed["cat"]), "c1"; got != want {
+		t.Errorf("cat removed got %s, want %s", got, want)
+	}
+	if got, want := sortedKeys(removed["dog"]), "d1,d2"; got != want {
+		t.Errorf("dog removed got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,353 @@
+package mosaic
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config describes how to reach an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the base URL of the store, such as
+	// "https://s3.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	// Region is used when signing requests. Defaults to "us-east-1".
+	Region string
+	// Bucket is the name of the bucket to store images in.
+	Bucket string
+	// AccessKey and SecretKey are the credentials. If AccessKey is empty,
+	// requests are sent unsigned.
+	AccessKey string
+	SecretKey string
+	// Client is the HTTP client to use. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// s3ImageCache implements an ImageCache in an S3-compatible bucket. Images
+// are stored as "<prefix>/<key>.jpg" using path-style addressing.
+type s3ImageCache struct {
+	S3Config
+	Prefix string
+}
+
+// NewS3ImageCache initializes a new cache to store images in an S3-compatible
+// bucket. All objects are stored beneath prefix, typically the tag name.
+func NewS3ImageCache(cfg S3Config, prefix string) ImageCache {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	return &s3ImageCache{cfg, strings.Trim(prefix, "/")}
+}
+
+func (c s3ImageCache) Key(name string) ImageCacheKey {
+	return hashKey(name)
+}
+
+func (c s3ImageCache) Put(key ImageCacheKey, m image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, m, nil); err != nil {
+		return err
+	}
+	res, err := c.do("PUT", c.keyToObject(key), nil, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put %s failed, status %d", key, res.StatusCode)
+	}
+	return nil
+}
+
+func (c s3ImageCache) Get(key ImageCacheKey) (image.Image, error) {
+	res, err := c.do("GET", c.keyToObject(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &NotCachedError{key}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 get %s failed, status %d", key, res.StatusCode)
+	}
+	m, err := jpeg.Decode(res.Body)
+	if err != nil {
+		return nil, &CorruptImageError{key, err}
+	}
+	return m, nil
+}
+
+func (c s3ImageCache) Has(key ImageCacheKey) bool {
+	res, err := c.do("HEAD", c.keyToObject(key), nil, nil)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// Delete removes an image and its attribution from the bucket.
+func (c s3ImageCache) Delete(key ImageCacheKey) error {
+	for _, object := range []string{c.keyToObject(key), c.keyToAttributionObject(key)} {
+		res, err := c.do("DELETE", object, nil, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("s3 delete %s failed, status %d", key, res.StatusCode)
+		}
+	}
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that we use.
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// s3Prefix is a group of objects in a listing with a delimiter.
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3Object is an entry in a listing.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+func (c s3ImageCache) Keys() ([]ImageCacheKey, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return []ImageCacheKey{}, err
+	}
+	keys := make([]ImageCacheKey, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys, nil
+}
+
+// Entries lists the images beneath the prefix. S3 doesn't track reads, so
+// Accessed is the same as Modified.
+func (c s3ImageCache) Entries() ([]CacheEntry, error) {
+	entries := []CacheEntry{}
+	var token string
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", c.Prefix+"/")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		list, err := c.list(q)
+		if err != nil {
+			return []CacheEntry{}, err
+		}
+		for _, o := range list.Contents {
+			if key, ok := c.objectToKey(o.Key); ok {
+				entries = append(entries, CacheEntry{
+					Key:      key,
+					Bytes:    o.Size,
+					Modified: o.LastModified,
+					Accessed: o.LastModified,
+				})
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	return entries, nil
+}
+
+// ListS3Prefixes returns the prefixes that objects are stored beneath in the
+// bucket, such as the tags of caches made by NewS3ImageCache.
+func ListS3Prefixes(cfg S3Config) ([]string, error) {
+	c := NewS3ImageCache(cfg, "").(*s3ImageCache)
+	prefixes := []string{}
+	var token string
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("delimiter", "/")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		list, err := c.list(q)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, p := range list.CommonPrefixes {
+			prefixes = append(prefixes, strings.TrimSuffix(p.Prefix, "/"))
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+	return prefixes, nil
+}
+
+func (c s3ImageCache) Size() int {
+	list, err := c.Keys()
+	if err == nil {
+		return len(list)
+	}
+	return 0
+}
+
+// list performs one page of a ListObjectsV2 call.
+func (c s3ImageCache) list(q url.Values) (*s3ListResult, error) {
+	res, err := c.do("GET", "", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 list %s failed, status %d", c.Prefix, res.StatusCode)
+	}
+	var list s3ListResult
+	if err := xml.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (c s3ImageCache) keyToObject(key ImageCacheKey) string {
+	return fmt.Sprintf("%s/%s.jpg", c.Prefix, key)
+}
+
+func (c s3ImageCache) objectToKey(name string) (ImageCacheKey, bool) {
+	name = strings.TrimPrefix(name, c.Prefix+"/")
+	if strings.Contains(name, "/") || !strings.HasSuffix(name, ".jpg") {
+		return "", false
+	}
+	return ImageCacheKey(strings.TrimSuffix(name, ".jpg")), true
+}
+
+// do sends a signed request for an object in the bucket. An empty object
+// addresses the bucket itself.
+func (c s3ImageCache) do(method, object string, q url.Values, body []byte) (*http.Response, error) {
+	p := "/" + c.Bucket
+	if object != "" {
+		p += "/" + object
+	}
+	u, err := url.Parse(c.Endpoint + p)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3EncodeQuery(q)
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		if strings.HasSuffix(object, ".json") {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "image/jpeg")
+		}
+	}
+	c.sign(req, body, time.Now().UTC())
+	return c.Client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+// http://docs.aws.amazon.com/general/latest/gr/signature-version-4.html
+func (c s3ImageCache) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.AccessKey == "" {
+		return
+	}
+
+	// Canonical headers are lowercased and sorted by name.
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, c.Region, "s3", "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EncodeQuery encodes query parameters sorted by key, with spaces as %20 as
+// required for the canonical request.
+func s3EncodeQuery(q url.Values) string {
+	return strings.Replace(q.Encode(), "+", "%20", -1)
+}
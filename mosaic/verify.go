@@ -0,0 +1,122 @@
+package mosaic
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+const (
+	// ProblemCorrupt is an entry that can't be decoded, including empty files.
+	ProblemCorrupt = "corrupt"
+	// ProblemUndersized is an entry smaller than the minimum size.
+	ProblemUndersized = "undersized"
+	// ProblemDuplicate is an entry with the same pixels as another entry.
+	ProblemDuplicate = "duplicate"
+)
+
+// CacheReport describes the health of the entries in an ImageCache.
+type CacheReport struct {
+	// Checked is the number of entries examined.
+	Checked int `json:"checked"`
+	// OK is the number of entries with no problems.
+	OK int `json:"ok"`
+	// Problems lists each bad entry.
+	Problems []CacheProblem `json:"problems"`
+	// Removed lists the entries deleted by RepairCache.
+	Removed []ImageCacheKey `json:"removed"`
+}
+
+// CacheProblem describes one bad entry in an ImageCache.
+type CacheProblem struct {
+	Key    ImageCacheKey `json:"key"`
+	Kind   string        `json:"kind"`
+	Detail string        `json:"detail"`
+	// DuplicateOf is the entry that a duplicate matches.
+	DuplicateOf ImageCacheKey `json:"duplicate_of,omitempty"`
+}
+
+// VerifyCache decodes every entry in the cache and reports those that are
+// corrupt, smaller than minSize in either dimension, or duplicates of another
+// entry. An entry that can't be read for another reason, such as a network
+// error, stops the run so that a healthy entry is never reported.
+func VerifyCache(cache ImageCache, minSize int) (*CacheReport, error) {
+	keys, err := cache.Keys()
+	if err != nil {
+		return nil, err
+	}
+	report := &CacheReport{
+		Problems: []CacheProblem{},
+		Removed:  []ImageCacheKey{},
+	}
+	seen := make(map[string]ImageCacheKey)
+	for _, key := range keys {
+		report.Checked++
+		m, err := cache.Get(key)
+		if IsNotCached(err) {
+			// Removed since listing, nothing to report.
+			report.Checked--
+			continue
+		}
+		if IsCorrupt(err) {
+			report.add(key, ProblemCorrupt, err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b := m.Bounds()
+		if b.Dx() < minSize || b.Dy() < minSize {
+			report.add(key, ProblemUndersized, fmt.Sprintf("%dx%d is smaller than %dx%d", b.Dx(), b.Dy(), minSize, minSize))
+			continue
+		}
+		sum := pixelHash(m)
+		if orig, ok := seen[sum]; ok {
+			report.Problems = append(report.Problems, CacheProblem{
+				Key:         key,
+				Kind:        ProblemDuplicate,
+				Detail:      fmt.Sprintf("same pixels as %s", orig),
+				DuplicateOf: orig,
+			})
+			continue
+		}
+		seen[sum] = key
+		report.OK++
+	}
+	return report, nil
+}
+
+func (r *CacheReport) add(key ImageCacheKey, kind, detail string) {
+	r.Problems = append(r.Problems, CacheProblem{
+		Key:    key,
+		Kind:   kind,
+		Detail: detail,
+	})
+}
+
+// RepairCache deletes every entry with a problem in the report, recording
+// them in report.Removed. Stale temp files are removed too.
+func RepairCache(cache ImageCache, report *CacheReport) error {
+	if err := removeStaleTemp(cache); err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		if err := cache.Delete(p.Key); err != nil {
+			return err
+		}
+		report.Removed = append(report.Removed, p.Key)
+	}
+	return nil
+}
+
+// pixelHash returns a digest of the image's pixels, independent of how it was
+// encoded.
+func pixelHash(m image.Image) string {
+	b := m.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), m, b.Min, draw.Src)
+	sum := sha1.Sum(rgba.Pix)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,100 @@
+package mosaic
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestVerifyCache(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	box := image.Rect(0, 0, 100, 100)
+	c.Put("red", solidImg(box, color.RGBA{255, 0, 0, 255}))
+	c.Put("blue", solidImg(box, color.RGBA{0, 0, 255, 255}))
+	c.Put("tiny", solidImg(image.Rect(0, 0, 10, 10), color.White))
+	c.Put("broken", solidImg(box, color.Black))
+	c.errorOnGet = "broken"
+
+	report, err := VerifyCache(c, 50)
+	if err != nil {
+		t.Fatalf("VerifyCache got error %s", err)
+	}
+	if got, want := report.Checked, 4; got != want {
+		t.Errorf("Checked got %d, want %d", got, want)
+	}
+	if got, want := report.OK, 2; got != want {
+		t.Errorf("OK got %d, want %d", got, want)
+	}
+	kinds := make(map[ImageCacheKey]string)
+	for _, p := range report.Problems {
+		kinds[p.Key] = p.Kind
+	}
+	if got, want := kinds["tiny"], ProblemUndersized; got != want {
+		t.Errorf("tiny got %q, want %q", got, want)
+	}
+	if got, want := kinds["broken"], ProblemCorrupt; got != want {
+		t.Errorf("broken got %q, want %q", got, want)
+	}
+
+	// Repair removes the bad entries.
+	if err := RepairCache(c, report); err != nil {
+		t.Fatalf("RepairCache got error %s", err)
+	}
+	if got, want := len(report.Removed), 2; got != want {
+		t.Errorf("Removed got %d, want %d", got, want)
+	}
+	if got, want := c.Size(), 2; got != want {
+		t.Errorf("Size got %d, want %d", got, want)
+	}
+}
+
+func TestVerifyCache_readError(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	box := image.Rect(0, 0, 100, 100)
+	c.Put("red", solidImg(box, color.RGBA{255, 0, 0, 255}))
+	c.Put("unreachable", solidImg(box, color.Black))
+	c.failOnGet = "unreachable"
+
+	// A transient error isn't reported as a problem, so nothing is
+	// repaired.
+	report, err := VerifyCache(c, 50)
+	if err == nil {
+		t.Fatalf("VerifyCache should fail, got %+v", report)
+	}
+	if report != nil {
+		if err := RepairCache(c, report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.Has("unreachable") {
+		t.Errorf("unreachable should not be deleted")
+	}
+}
+
+func TestVerifyCache_duplicates(t *testing.T) {
+	c := &fakeCache{
+		store: make(map[ImageCacheKey]image.Image),
+	}
+	box := image.Rect(0, 0, 100, 100)
+	c.Put("a", solidImg(box, color.White))
+	c.Put("b", solidImg(box, color.White))
+
+	report, err := VerifyCache(c, 0)
+	if err != nil {
+		t.Fatalf("VerifyCache got error %s", err)
+	}
+	if got, want := len(report.Problems), 1; got != want {
+		t.Fatalf("Problems got %d, want %d", got, want)
+	}
+	p := report.Problems[0]
+	if p.Kind != ProblemDuplicate {
+		t.Errorf("Kind got %q, want %q", p.Kind, ProblemDuplicate)
+	}
+	if p.Key == p.DuplicateOf {
+		t.Errorf("want DuplicateOf to be the other key, got %s", p.DuplicateOf)
+	}
+}
@@ -1,36 +1,79 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"image"
 	"image/color/palette"
 	"image/jpeg"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
 	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
 	"github.com/rcarver/golang-challenge-3-mosaic/service"
+	"github.com/rcarver/golang-challenge-3-mosaic/source"
 )
 
 var (
-	fetch         *flag.FlagSet
-	gen           *flag.FlagSet
-	serve         *flag.FlagSet
-	tag           string
-	baseDirName   string
-	imgDirName    string
-	inName        string
-	outName       string
-	outDownsample float64
-	units         int
-	unitSize      int
-	numImages     int
-	solid         bool
-	port          int
+	fetch           *flag.FlagSet
+	gen             *flag.FlagSet
+	serve           *flag.FlagSet
+	cache           *flag.FlagSet
+	prune           *flag.FlagSet
+	cacheAction     string
+	tag             string
+	baseDirName     string
+	imgDirName      string
+	inName          string
+	outName         string
+	outDownsample   float64
+	units           int
+	unitSize        int
+	numImages       int
+	solid           bool
+	port            int
+	minSize         int
+	jsonReport      bool
+	refetch         bool
+	dedupe          int
+	hashName        string
+	tagQuota        mosaic.Quota
+	totalQuota      mosaic.Quota
+	evictName       string
+	workers         int
+	fetchTimeout    time.Duration
+	sourceName      string
+	sourcePath      string
+	creditsName     string
+	allMedia        bool
+	minImageSize    int
+	saturation      [2]float64
+	brightness      [2]float64
+	excludeTags     string
+	excludeUsers    string
+	feed            source.FeedConfig
+	popular         bool
+	location        instagram.LocationQuery
+	since           time.Duration
+	mosaicWorkers   int
+	queueDepth      int
+	maxUnits        int
+	maxUnitSize     int
+	maxOutputPixels int
+	retention       time.Duration
+	sourceHosts     string
+	maxSourceSize   int64
+	callbackHosts   string
+	imageMaxAge     time.Duration
+	maxRenders      int
 )
 
 var help = `
@@ -46,6 +89,18 @@ func init() {
 	fetch.StringVar(&baseDirName, "dir", "./cache/thumbs", "dir to store images by tag")
 	fetch.StringVar(&tag, "tag", "cat", "image tag to use")
 	fetch.IntVar(&numImages, "num", 1000, "number of images to download")
+	fetch.StringVar(&sourceName, "source", "instagram", "where to get images: instagram, dir or feed")
+	fetch.StringVar(&sourcePath, "path", "", "dir to read images from with -source dir")
+	feedFlags(fetch)
+	fetch.BoolVar(&popular, "popular", false, "fetch Instagram's popular images instead of a tag (stored as tag popular)")
+	fetch.StringVar(&location.Lat, "lat", "", "fetch Instagram images posted near this latitude, with -lng")
+	fetch.StringVar(&location.Lng, "lng", "", "fetch Instagram images posted near this longitude, with -lat")
+	fetch.IntVar(&location.Distance, "distance", 0, "with -lat and -lng, search radius in meters, up to 5000")
+	fetch.DurationVar(&since, "since", 0, "with -lat and -lng, only images posted within this long, such as 24h")
+	fetch.IntVar(&workers, "workers", mosaic.DefaultFetchWorkers, "number of images to download at once")
+	fetch.DurationVar(&fetchTimeout, "timeout", 0, "stop fetching after this long, such as 5m (no limit by default)")
+	fetch.IntVar(&dedupe, "dedupe", -1, "skip images within this hash distance of another, -1 to allow duplicates")
+	fetch.StringVar(&hashName, "hash", "dhash", "hash used to find duplicates: ahash, dhash or phash")
 
 	gen = flag.NewFlagSet("gen", flag.ExitOnError)
 	gen.StringVar(&baseDirName, "dir", "./cache/thumbs", "dir to store images by tag")
@@ -57,13 +112,113 @@ func init() {
 	gen.IntVar(&units, "units", 40, "number of units wide to generate the mosaic")
 	gen.IntVar(&unitSize, "unitSize", instagram.ThumbnailSize, "pixels w/h of the thumbnail images")
 	gen.BoolVar(&solid, "solid", false, "generate a mosaic with solid colors, not images")
+	gen.StringVar(&creditsName, "credits", "", "JSON file to write credits for the images used")
 
 	serve = flag.NewFlagSet("serve", flag.ExitOnError)
 	serve.StringVar(&baseDirName, "dir", "./cache", "dir to store thumbs and mosaics")
 	serve.IntVar(&numImages, "num", 1000, "number of images to download")
+	serve.IntVar(&workers, "workers", mosaic.DefaultFetchWorkers, "number of images to download at once per tag")
+	serve.DurationVar(&fetchTimeout, "timeout", service.FetchTimeout, "stop fetching a tag after this long")
 	serve.IntVar(&units, "units", 40, "number of units wide to generate the mosaic")
 	serve.IntVar(&unitSize, "unitSize", instagram.ThumbnailSize, "pixels w/h of the thumbnail images")
 	serve.IntVar(&port, "port", 8080, "port number of the server")
+	serve.IntVar(&maxUnits, "maxUnits", service.MaxUnits, "most units a request may ask for")
+	serve.IntVar(&maxUnitSize, "maxUnitSize", service.MaxUnitSize, "largest unit size a request may ask for")
+	serve.IntVar(&maxOutputPixels, "maxOutputPixels", service.MaxOutputPixels, "largest mosaic a request may ask for, as units*unitSize squared")
+	serve.DurationVar(&imageMaxAge, "imageMaxAge", service.ImageMaxAge, "how long clients and CDNs may cache mosaic images")
+	serve.IntVar(&maxRenders, "maxRenders", service.MaxRenders, "most mosaic image renditions to make at once")
+	serve.DurationVar(&retention, "retention", 0, "delete mosaics this long after they're created, such as 168h (kept forever by default)")
+	serve.StringVar(&sourceHosts, "sourceHosts", "", "comma separated hosts that mosaics may be created from with src_url, such as *.example.com")
+	serve.Int64Var(&maxSourceSize, "maxSourceBytes", service.MaxSourceBytes, "largest image to download with src_url")
+	serve.StringVar(&callbackHosts, "callbackHosts", "", "comma separated hosts that mosaics may be posted to with callback_url, such as hooks.example.com")
+	serve.IntVar(&mosaicWorkers, "mosaicWorkers", service.MosaicWorkers, "number of mosaics to generate at once")
+	serve.IntVar(&queueDepth, "queueDepth", service.QueueDepth, "number of mosaics that may wait to be generated")
+	serve.IntVar(&dedupe, "dedupe", -1, "skip images within this hash distance of another, -1 to allow duplicates")
+	serve.StringVar(&hashName, "hash", "dhash", "hash used to find duplicates: ahash, dhash or phash")
+
+	cache = flag.NewFlagSet("cache <verify|repair|dedupe>", flag.ExitOnError)
+	cache.StringVar(&baseDirName, "dir", "./cache/thumbs", "dir to store images by tag")
+	cache.StringVar(&tag, "tag", "cat", "image tag to check")
+	cache.StringVar(&imgDirName, "imgdir", "", "dir to find images (uses $dir/thumbs/$tag by default)")
+	cache.IntVar(&minSize, "minSize", instagram.ThumbnailSize, "pixels w/h below which an image is undersized")
+	cache.BoolVar(&jsonReport, "json", false, "print the report as JSON")
+	cache.BoolVar(&refetch, "refetch", false, "repair: download new images to replace those removed as corrupt")
+	cache.StringVar(&sourceName, "source", "instagram", "repair: where to get images: instagram, dir or feed")
+	cache.StringVar(&sourcePath, "path", "", "repair: dir to read images from with -source dir")
+	feedFlags(cache)
+	cache.IntVar(&dedupe, "dedupe", 4, "dedupe: remove images within this hash distance of another")
+	cache.StringVar(&hashName, "hash", "dhash", "dedupe: hash used to find duplicates: ahash, dhash or phash")
+
+	prune = flag.NewFlagSet("prune", flag.ExitOnError)
+	prune.StringVar(&baseDirName, "dir", "./cache/thumbs", "dir to store images by tag")
+	prune.StringVar(&tag, "tag", "", "image tag to prune (all tags by default)")
+	quotaFlags(prune)
+	quotaFlags(serve)
+	filterFlags(fetch)
+	filterFlags(serve)
+}
+
+// quotaFlags adds flags to configure thumbnail quotas and eviction.
+func quotaFlags(fs *flag.FlagSet) {
+	fs.IntVar(&tagQuota.MaxEntries, "max", 0, "most images to keep per tag, 0 for no limit")
+	fs.Int64Var(&tagQuota.MaxBytes, "maxBytes", 0, "most bytes to keep per tag, 0 for no limit")
+	fs.IntVar(&totalQuota.MaxEntries, "totalMax", 0, "most images to keep for all tags, 0 for no limit")
+	fs.Int64Var(&totalQuota.MaxBytes, "totalBytes", 0, "most bytes to keep for all tags, 0 for no limit")
+	fs.StringVar(&evictName, "evict", string(mosaic.EvictOldest), "images to remove first: age, lru or coverage")
+}
+
+func filterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&allMedia, "allMedia", false, "keep video thumbnails, not just photos")
+	fs.IntVar(&minImageSize, "minImageSize", 0, "skip images smaller than this many pixels w/h")
+	fs.Float64Var(&saturation[0], "minSaturation", 0, "skip images less saturated than this, 0-1, such as 0.1 to skip near-monochrome")
+	fs.Float64Var(&saturation[1], "maxSaturation", 0, "skip images more saturated than this, 0-1, 0 for no limit")
+	fs.Float64Var(&brightness[0], "minBrightness", 0, "skip images darker than this, 0-1")
+	fs.Float64Var(&brightness[1], "maxBrightness", 0, "skip images brighter than this, 0-1, such as 0.9 to skip screenshots, 0 for no limit")
+	fs.StringVar(&excludeTags, "excludeTags", "", "skip images with any of these comma separated tags")
+	fs.StringVar(&excludeUsers, "excludeUsers", "", "skip images by any of these comma separated users")
+}
+
+// fetchFilters returns the filters set by filterFlags.
+func fetchFilters() []mosaic.FilterFunc {
+	filters := []mosaic.FilterFunc{}
+	if !allMedia {
+		filters = append(filters, mosaic.PhotosOnly())
+	}
+	if minImageSize > 0 {
+		filters = append(filters, mosaic.MinSize(minImageSize, minImageSize))
+	}
+	if saturation[0] > 0 || saturation[1] > 0 {
+		filters = append(filters, mosaic.SaturationRange(saturation[0], saturation[1]))
+	}
+	if brightness[0] > 0 || brightness[1] > 0 {
+		filters = append(filters, mosaic.BrightnessRange(brightness[0], brightness[1]))
+	}
+	if excludeTags != "" {
+		filters = append(filters, mosaic.ExcludeTags(strings.Split(excludeTags, ",")...))
+	}
+	if excludeUsers != "" {
+		filters = append(filters, mosaic.ExcludeUsers(strings.Split(excludeUsers, ",")...))
+	}
+	return filters
+}
+
+// flagSet returns true if the named flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func feedFlags(fs *flag.FlagSet) {
+	fs.StringVar(&feed.URL, "url", "", "feed url to read images from with -source feed")
+	fs.StringVar(&feed.Format, "format", "", "feed format: json or rss (detected by default)")
+	fs.StringVar(&feed.Selector, "select", "", "JSON feed: selector for image urls, such as $.items[*].url")
+	fs.StringVar(&feed.NextSelector, "next", "", "JSON feed: selector for the next page url, such as $.next")
+	fs.IntVar(&feed.MaxPages, "pages", 0, "most feed pages to read, 0 for no limit")
 }
 
 func main() {
@@ -76,10 +231,36 @@ func main() {
 	switch command {
 	case "fetch":
 		fetch.Parse(os.Args[2:])
+		if since > 0 {
+			location.MinTime = time.Now().Add(-since)
+		}
+		// Popular and location images are stored by their own name unless
+		// -tag is given.
+		if !flagSet(fetch, "tag") {
+			switch {
+			case popular:
+				tag = service.PopularTag
+			case location.Lat != "" || location.Lng != "":
+				tag = service.LocationTag(location)
+			}
+		}
 	case "gen":
 		gen.Parse(os.Args[2:])
 	case "serve":
 		serve.Parse(os.Args[2:])
+	case "cache":
+		if len(os.Args) > 2 {
+			cacheAction = os.Args[2]
+		}
+		if cacheAction != "verify" && cacheAction != "repair" && cacheAction != "dedupe" {
+			fmt.Println(usage)
+			fmt.Printf("cache:\n")
+			cache.PrintDefaults()
+			os.Exit(2)
+		}
+		cache.Parse(os.Args[3:])
+	case "prune":
+		prune.Parse(os.Args[2:])
 	default:
 		fmt.Println(usage)
 		fmt.Printf("fetch:\n")
@@ -88,6 +269,10 @@ func main() {
 		gen.PrintDefaults()
 		fmt.Printf("serve:\n")
 		serve.PrintDefaults()
+		fmt.Printf("cache <verify|repair|dedupe>:\n")
+		cache.PrintDefaults()
+		fmt.Printf("prune:\n")
+		prune.PrintDefaults()
 		os.Exit(2)
 	}
 
@@ -102,13 +287,40 @@ func main() {
 		fmt.Printf("Error initializing: %s\n", err)
 	}
 
-	// inventory reads and writes from the dir.
-	inventory := newInventory(thumbsDir)
+	// inventory reads and writes from the dir, or the object store.
+	inventory := newInventory(thumbsDir, tag)
+
+	hashFunc, ok := mosaic.HashFuncs[hashName]
+	if !ok && hashName != "" {
+		fmt.Printf("Unknown -hash %s\n", hashName)
+		os.Exit(1)
+	}
+	eviction, err := mosaic.ParseEvictionPolicy(evictName)
+	if err != nil && (command == "prune" || command == "serve") {
+		fmt.Printf("Error initializing: %s\n", err)
+		os.Exit(1)
+	}
 
 	switch command {
 	case "fetch":
-		if err := downloadImages(tag, numImages, inventory); err != nil {
-			fmt.Printf("Download error: %s\n", err)
+		inventory.SetFetchWorkers(workers)
+		inventory.Filter(fetchFilters()...)
+		if dedupe >= 0 {
+			inventory.RejectDuplicates(hashFunc, dedupe)
+		}
+		ctx, cancel := fetchContext()
+		defer cancel()
+		if err := downloadImages(ctx, tag, numImages, inventory); err != nil {
+			switch {
+			case instagram.IsRateLimited(err):
+				fmt.Printf("Download stopped by Instagram's rate limit, %d images stored. Try again later.\n", inventory.Size())
+			case instagram.IsUnauthorized(err):
+				fmt.Printf("Download error, Instagram rejected the credentials: %s\n", err)
+			case instagram.IsNotFound(err):
+				fmt.Printf("Download error, no images for tag %s\n", tag)
+			default:
+				fmt.Printf("Download error: %s\n", err)
+			}
 			os.Exit(1)
 		}
 		os.Exit(0)
@@ -132,7 +344,7 @@ func main() {
 		}
 
 		// Generate the mosaic.
-		img, err := generateMosaic(src, tag, units, solid, inventory)
+		img, credits, err := generateMosaic(src, tag, units, solid, inventory)
 		if err != nil {
 			fmt.Printf("Error generating: %s\n", err)
 			os.Exit(1)
@@ -151,35 +363,276 @@ func main() {
 			os.Exit(1)
 		}
 
+		// Write the credits for the images used.
+		if creditsName != "" {
+			js, err := json.MarshalIndent(credits, "", "  ")
+			if err == nil {
+				err = ioutil.WriteFile(creditsName, js, 0644)
+			}
+			if err != nil {
+				fmt.Printf("Error outputting credits: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
 		os.Exit(0)
 	case "serve":
 		service.HostPort = fmt.Sprintf(":%d", port)
 		service.MosaicsDir = path.Join(baseDirName, "mosaics")
 		service.ThumbsDir = path.Join(baseDirName, "thumbs")
 		service.ImagesPerTag = numImages
+		service.FetchWorkers = workers
+		service.FetchTimeout = fetchTimeout
 		service.Units = units
 		service.UnitSize = unitSize
+		service.MaxUnits = maxUnits
+		service.MaxUnitSize = maxUnitSize
+		service.MaxOutputPixels = maxOutputPixels
+		service.MosaicWorkers = mosaicWorkers
+		service.MosaicRetention = retention
+		service.ImageMaxAge = imageMaxAge
+		service.MaxRenders = maxRenders
+		if sourceHosts != "" {
+			service.SourceHosts = strings.Split(sourceHosts, ",")
+		}
+		service.MaxSourceBytes = maxSourceSize
+		if callbackHosts != "" {
+			service.CallbackHosts = strings.Split(callbackHosts, ",")
+		}
+		service.CallbackSecret = os.Getenv("MOSAICLY_CALLBACK_SECRET")
+		service.QueueDepth = queueDepth
+		if dedupe >= 0 {
+			service.DedupeHash = hashFunc
+			service.DedupeDistance = dedupe
+		}
+		service.Filters = fetchFilters()
+		service.TagQuota = tagQuota
+		service.TotalQuota = totalQuota
+		service.Eviction = eviction
+		if cfg, ok := s3Config(); ok {
+			service.ThumbsCache = func(tag string) mosaic.ImageCache {
+				return mosaic.NewS3ImageCache(cfg, tag)
+			}
+			service.ThumbsTags = func() ([]string, error) {
+				return mosaic.ListS3Prefixes(cfg)
+			}
+		}
+		api, err := newInstagramClient()
+		if err != nil {
+			fmt.Printf("Error initializing: %s\n", err)
+			os.Exit(1)
+		}
+		service.Instagram = api
 		service.Serve()
 		os.Exit(0)
+	case "cache":
+		if cacheAction == "dedupe" {
+			removed, err := inventory.RemoveDuplicates(hashFunc, dedupe)
+			if err != nil {
+				fmt.Printf("Cache error: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Removed %d duplicates\n", len(removed))
+			os.Exit(0)
+		}
+		report, err := checkCache(cacheAction == "repair", inventory)
+		if err != nil {
+			fmt.Printf("Cache error: %s\n", err)
+			os.Exit(1)
+		}
+		if jsonReport {
+			js, _ := json.MarshalIndent(report, "", "  ")
+			fmt.Println(string(js))
+		} else {
+			printReport(report)
+		}
+		if cacheAction == "verify" && len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "prune":
+		removed, err := pruneImages(eviction)
+		if err != nil {
+			fmt.Printf("Prune error: %s\n", err)
+			os.Exit(1)
+		}
+		for t, keys := range removed {
+			fmt.Printf("Removed %d images from %s\n", len(keys), t)
+		}
+		os.Exit(0)
 	default:
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 }
 
-func newInventory(dir string) *mosaic.ImageInventory {
-	cache := mosaic.NewFileImageCache(dir)
+func newInventory(dir, tag string) *mosaic.ImageInventory {
+	var cache mosaic.ImageCache
+	if cfg, ok := s3Config(); ok && imgDirName == "" {
+		cache = mosaic.NewS3ImageCache(cfg, tag)
+	} else {
+		cache = mosaic.NewFileImageCache(dir)
+	}
 	return mosaic.NewImageInventory(cache)
 }
 
-func downloadImages(tag string, numImages int, inv *mosaic.ImageInventory) error {
-	api := instagram.NewClient()
-	fetcher := instagram.NewTagFetcher(api, tag)
-	if err := inv.Fetch(fetcher, numImages); err != nil {
+// s3Config reads object store settings from the environment. Thumbs are
+// stored in the bucket if MOSAICLY_S3_BUCKET is set.
+func s3Config() (mosaic.S3Config, bool) {
+	cfg := mosaic.S3Config{
+		Endpoint:  os.Getenv("MOSAICLY_S3_ENDPOINT"),
+		Region:    os.Getenv("MOSAICLY_S3_REGION"),
+		Bucket:    os.Getenv("MOSAICLY_S3_BUCKET"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3.amazonaws.com"
+	}
+	return cfg, cfg.Bucket != ""
+}
+
+// newInstagramClient returns a client using the credentials in the file named
+// by INSTAGRAM_CONFIG and the INSTAGRAM_* environment variables. The API can
+// be pointed elsewhere, such as a mock server, with INSTAGRAM_API_URL.
+func newInstagramClient() (instagram.Client, error) {
+	creds, err := instagram.LoadCredentials(os.Getenv("INSTAGRAM_CONFIG"))
+	if err != nil {
+		return nil, err
+	}
+	return instagram.NewClientWithOptions(instagram.ClientOptions{
+		BaseURL:     os.Getenv("INSTAGRAM_API_URL"),
+		Credentials: creds,
+	}), nil
+}
+
+// pruneImages enforces quotas on the tag, or on every tag in the thumbs dir.
+func pruneImages(eviction mosaic.EvictionPolicy) (map[string][]mosaic.ImageCacheKey, error) {
+	thumbsDir := path.Join(baseDirName, "thumbs")
+	tags := []string{tag}
+	if tag == "" {
+		infos, err := ioutil.ReadDir(thumbsDir)
+		if err != nil {
+			return nil, err
+		}
+		tags = tags[:0]
+		for _, info := range infos {
+			if info.IsDir() {
+				tags = append(tags, info.Name())
+			}
+		}
+	}
+	invs := make(map[string]*mosaic.ImageInventory, len(tags))
+	for _, t := range tags {
+		invs[t] = newInventory(path.Join(thumbsDir, t), t)
+	}
+	return mosaic.PruneInventories(invs, tagQuota, totalQuota, eviction)
+}
+
+func downloadImages(ctx context.Context, tag string, numImages int, inv *mosaic.ImageInventory) error {
+	src, err := newSource(tag)
+	if err != nil {
 		return err
 	}
-	time.Sleep(1 * time.Second)
-	return nil
+	return inv.Fetch(ctx, src, numImages)
+}
+
+// newSource returns the source of images named by -source.
+func newSource(tag string) (source.Source, error) {
+	switch sourceName {
+	case "instagram":
+		api, err := newInstagramClient()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case popular:
+			return instagram.NewSource(instagram.NewPopularFetcher(api)), nil
+		case location.Lat != "" || location.Lng != "":
+			if location.Lat == "" || location.Lng == "" {
+				return nil, fmt.Errorf("-lat and -lng must be used together")
+			}
+			return instagram.NewSource(instagram.NewLocationFetcher(api, location)), nil
+		}
+		return instagram.NewSource(instagram.NewTagFetcher(api, tag)), nil
+	case "dir":
+		if sourcePath == "" {
+			return nil, fmt.Errorf("missing -path for -source dir")
+		}
+		return source.NewDirSource(sourcePath), nil
+	case "feed":
+		if feed.URL == "" {
+			return nil, fmt.Errorf("missing -url for -source feed")
+		}
+		switch feed.Format {
+		case "", source.FormatJSON, source.FormatRSS:
+		default:
+			return nil, fmt.Errorf("unknown -format %s", feed.Format)
+		}
+		return source.NewFeedSource(feed), nil
+	}
+	return nil, fmt.Errorf("unknown -source %s", sourceName)
+}
+
+// fetchContext returns a context that's cancelled by an interrupt, or after
+// fetchTimeout if it's set.
+func fetchContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	cancelTimeout := func() {}
+	if fetchTimeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(ctx, fetchTimeout)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			log.Printf("Interrupted, stopping...\n")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, func() {
+		cancel()
+		cancelTimeout()
+	}
+}
+
+// checkCache verifies the inventory's images. If repair is true, bad images
+// are removed and, with -refetch, corrupt ones are replaced by fetching more.
+// Undersized and duplicate images aren't replaced, fetching again would most
+// likely store the same images.
+func checkCache(repair bool, inv *mosaic.ImageInventory) (*mosaic.CacheReport, error) {
+	report, err := inv.Verify(minSize)
+	if err != nil || !repair {
+		return report, err
+	}
+	if err := inv.Repair(report); err != nil {
+		return report, err
+	}
+	var corrupt int
+	for _, p := range report.Problems {
+		if p.Kind == mosaic.ProblemCorrupt {
+			corrupt++
+		}
+	}
+	if refetch && corrupt > 0 {
+		ctx, cancel := fetchContext()
+		defer cancel()
+		if err := downloadImages(ctx, tag, inv.Size()+corrupt, inv); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func printReport(r *mosaic.CacheReport) {
+	for _, p := range r.Problems {
+		fmt.Printf("%s\t%s\t%s\n", p.Kind, p.Key, p.Detail)
+	}
+	fmt.Printf("Checked %d, ok %d, problems %d, removed %d\n", r.Checked, r.OK, len(r.Problems), len(r.Removed))
 }
 
 var (
@@ -187,7 +640,7 @@ var (
 	paletteSize = 256
 )
 
-func generateMosaic(src image.Image, tag string, units int, solid bool, inv *mosaic.ImageInventory) (image.Image, error) {
+func generateMosaic(src image.Image, tag string, units int, solid bool, inv *mosaic.ImageInventory) (image.Image, []mosaic.Credit, error) {
 	var p *mosaic.ImagePalette
 	if solid {
 		p = mosaic.NewSolidPalette(palette.WebSafe)
@@ -195,13 +648,20 @@ func generateMosaic(src image.Image, tag string, units int, solid bool, inv *mos
 	} else {
 		p = mosaic.NewImagePalette(paletteSize)
 		if err := inv.PopulatePalette(p); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if p.NumColors() == 0 {
-			return nil, fmt.Errorf("No images are available")
+			return nil, nil, fmt.Errorf("No images are available")
 		}
 		log.Printf("Generating %dx%d %s mosaic with %d colors and %d images\n", units, units, tag, p.NumColors(), p.NumImages())
 	}
 	sq := mosaic.ComposeSquare(src, units, unitSize, p)
-	return mosaic.Shrink(sq, outDownsample), nil
+	credits, err := inv.Credits(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := inv.RecordUse(p); err != nil {
+		log.Printf("Failed to record image use: %s\n", err)
+	}
+	return mosaic.Shrink(sq, outDownsample), credits, nil
 }
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	// CallbackHosts are the hosts that may be given as a callback_url. An
+	// entry like "*.example.com" allows any subdomain, and one with a port
+	// only allows that port. If empty, callback_url is refused.
+	CallbackHosts []string
+	// CallbackSecret, if set, signs each callback with SignatureHeader.
+	CallbackSecret string
+	// CallbackAttempts is how many times a callback is tried before giving
+	// up.
+	CallbackAttempts = 5
+	// CallbackRetryDelay is the delay before the first retry. It doubles for
+	// each subsequent retry.
+	CallbackRetryDelay = 2 * time.Second
+	// CallbackTimeout is how long to wait for the receiver to respond.
+	CallbackTimeout = 10 * time.Second
+)
+
+// SignatureHeader is the header that signs a callback. Its value is
+// "sha256=" followed by the hex HMAC-SHA256 of the body, keyed with
+// CallbackSecret.
+const SignatureHeader = "X-Mosaic-Signature"
+
+// callbackDelivery records one attempt to deliver a callback.
+type callbackDelivery struct {
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	OK      bool      `json:"ok"`
+	// Status is the receiver's response status, if it responded.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// callbackClient posts callbacks. Redirects aren't followed, so that a
+// receiver can't point the service at a host that isn't allowed.
+var callbackClient = &http.Client{
+	CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// callbacks tracks the deliveries in progress.
+var callbacks sync.WaitGroup
+
+// requestCallback reads the request's callback_url, which must be on one of
+// CallbackHosts.
+func requestCallback(r *http.Request) (string, error) {
+	raw := r.FormValue("callback_url")
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", errInvalidParam("invalid 'callback_url' param")
+	}
+	if !hostAllowed(u, CallbackHosts) {
+		return "", errInvalidParam("callback host %s is not allowed", u.Host)
+	}
+	return u.String(), nil
+}
+
+// sendCallback delivers a mosaic to its callback_url in the background, if it
+// was created or failed.
+func sendCallback(id mosaicID) {
+	m, err := mosaics.Get(id)
+	if err != nil || m == nil {
+		log.Printf("Failed to get mosaic %s: %v\n", id, err)
+		return
+	}
+	if m.Params.CallbackURL == "" {
+		return
+	}
+	if m.Status != MosaicStatusCreated && m.Status != MosaicStatusFailed {
+		return
+	}
+	callbacks.Add(1)
+	go func() {
+		defer callbacks.Done()
+		deliverCallback(m)
+	}()
+}
+
+// deliverCallback posts the mosaic as JSON until the receiver accepts it,
+// retrying with backoff. Each attempt is added to the mosaic's deliveries.
+func deliverCallback(m *mosaicRecord) {
+	res := newMosaicRes(m)
+	res.Credits = m.Credits
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("Failed to encode mosaic callback: %s\n", err)
+		return
+	}
+	delay := CallbackRetryDelay
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		d := callbackDelivery{Attempt: attempt, Time: time.Now()}
+		status, err := postCallback(m.Params.CallbackURL, body)
+		d.Status = status
+		d.OK = err == nil && status >= 200 && status < 300
+		if err != nil {
+			d.Error = err.Error()
+		}
+		if err := mosaics.AddDelivery(m.ID, d); err != nil {
+			// Most likely the mosaic was deleted.
+			log.Printf("Failed to record mosaic callback: %s\n", err)
+			return
+		}
+		if d.OK {
+			log.Printf("Mosaic[%s] Callback delivered\n", m.ID)
+			return
+		}
+		// Only errors that may be temporary are retried.
+		if err == nil && status < 500 && status != http.StatusTooManyRequests {
+			break
+		}
+		if attempt < CallbackAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("Mosaic[%s] Callback failed\n", m.ID)
+}
+
+// postCallback posts a signed body to a callback URL, returning the
+// receiver's response status. It's only an error if there's no response.
+func postCallback(rawURL string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CallbackTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if CallbackSecret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+signCallback(CallbackSecret, body))
+	}
+	res, err := callbackClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// Drain the response so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	return res.StatusCode, nil
+}
+
+// signCallback calculates the hex HMAC-SHA256 of a callback body.
+func signCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_deliverCallback(t *testing.T) {
+	defer setupService(t, 0, 1)()
+	defer func(n int, d time.Duration) {
+		CallbackAttempts, CallbackRetryDelay = n, d
+	}(CallbackAttempts, CallbackRetryDelay)
+	CallbackAttempts = 3
+	CallbackRetryDelay = time.Millisecond
+
+	for _, test := range []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"accepted", http.StatusNoContent, 1},
+		{"refused", http.StatusBadRequest, 1},
+		{"redirected", http.StatusFound, 1},
+		{"unavailable", http.StatusServiceUnavailable, 3},
+		{"throttled", http.StatusTooManyRequests, 3},
+	} {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.status == http.StatusFound {
+				w.Header().Set("Location", "http://169.254.169.254/")
+			}
+			w.WriteHeader(test.status)
+		}))
+		m, err := mosaics.Create("cat", mosaicParams{CallbackURL: receiver.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverCallback(m)
+		receiver.Close()
+
+		m, err = mosaics.Get(m.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(m.Deliveries); got != test.attempts {
+			t.Errorf("%s got %d attempts, want %d", test.name, got, test.attempts)
+			continue
+		}
+		last := m.Deliveries[len(m.Deliveries)-1]
+		if last.Status != test.status || last.OK != (test.status == http.StatusNoContent) {
+			t.Errorf("%s got %+v", test.name, last)
+		}
+	}
+
+	// A receiver that's gone is retried.
+	m, err := mosaics.Create("cat", mosaicParams{CallbackURL: "http://127.0.0.1:1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverCallback(m)
+	if m, _ = mosaics.Get(m.ID); len(m.Deliveries) != 3 || m.Deliveries[2].Error == "" {
+		t.Errorf("got %+v, want 3 failed attempts", m.Deliveries)
+	}
+}
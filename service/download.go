@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// SourceHosts are the hosts that mosaics may be created from with
+	// src_url. An entry like "*.example.com" allows any subdomain, and one
+	// with a port only allows that port. If empty, src_url is refused.
+	SourceHosts []string
+	// MaxSourceBytes is the largest source image that's downloaded.
+	MaxSourceBytes int64 = 10 << 20
+	// MaxSourcePixels is the largest source image that's decoded, to refuse
+	// small files that decompress to huge images.
+	MaxSourcePixels = 50 * 1000 * 1000
+	// SourceTimeout is how long to spend downloading a source image.
+	SourceTimeout = 10 * time.Second
+)
+
+// errHostNotAllowed stops a redirect to a host that isn't in SourceHosts.
+var errHostNotAllowed = errors.New("host not allowed")
+
+// sourceClient downloads source images, refusing redirects to hosts that
+// aren't allowed.
+var sourceClient = &http.Client{
+	CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		if !sourceAllowed(r.URL) {
+			return errHostNotAllowed
+		}
+		return nil
+	},
+}
+
+// sourceAllowed returns true if u is an http(s) URL on one of SourceHosts.
+func sourceAllowed(u *url.URL) bool {
+	return hostAllowed(u, SourceHosts)
+}
+
+// hostAllowed returns true if u is an http(s) URL on one of hosts. An entry
+// like "*.example.com" allows any subdomain, and one with a port only allows
+// that port.
+func hostAllowed(u *url.URL, hosts []string) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		h := host
+		if strings.Contains(allowed, ":") {
+			// Compare the port too, defaulting it from the scheme.
+			port := u.Port()
+			if port == "" {
+				port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+			}
+			h = net.JoinHostPort(host, port)
+		}
+		if h == allowed {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(h, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadSource fetches and decodes the image at rawURL, within the limits
+// of SourceHosts, MaxSourceBytes, MaxSourcePixels and SourceTimeout.
+func downloadSource(ctx context.Context, rawURL string) (image.Image, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, errInvalidSource("invalid 'src_url' param")
+	}
+	if !sourceAllowed(u) {
+		return nil, errInvalidSource("host %s is not allowed", u.Host)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, SourceTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, errInvalidSource("invalid 'src_url' param")
+	}
+	req.Header.Set("Accept", "image/*")
+	res, err := sourceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == errHostNotAllowed {
+			return nil, errInvalidSource("redirect to %s is not allowed", uerr.URL)
+		}
+		return nil, errSourceUnavailable("downloading source: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errSourceUnavailable("downloading source: status %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		return nil, errInvalidSource("source is %q, not an image", ct)
+	}
+	if res.ContentLength > MaxSourceBytes {
+		return nil, errInvalidSource("source is larger than %d bytes", MaxSourceBytes)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxSourceBytes+1))
+	if err != nil {
+		return nil, errSourceUnavailable("downloading source: %s", err)
+	}
+	if int64(len(body)) > MaxSourceBytes {
+		return nil, errInvalidSource("source is larger than %d bytes", MaxSourceBytes)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, errInvalidSource("source image parsing failed: %s", err)
+	}
+	if cfg.Width*cfg.Height > MaxSourcePixels {
+		return nil, errInvalidSource("source is larger than %d pixels", MaxSourcePixels)
+	}
+	m, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, errInvalidSource("source image parsing failed: %s", err)
+	}
+	return m, nil
+}
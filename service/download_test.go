@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_sourceAllowed(t *testing.T) {
+	defer func(h []string) { SourceHosts = h }(SourceHosts)
+	SourceHosts = []string{"images.example.com", "*.cdn.example.com", "localhost:8080"}
+	for raw, want := range map[string]bool{
+		"https://images.example.com/a.jpg":        true,
+		"http://IMAGES.example.com:9000/a.jpg":    true,
+		"https://a.cdn.example.com/a.jpg":         true,
+		"https://cdn.example.com/a.jpg":           false,
+		"https://evilcdn.example.com/a.jpg":       false,
+		"https://example.com/a.jpg":               false,
+		"http://localhost:8080/a.jpg":             true,
+		"http://localhost/a.jpg":                  false,
+		"http://localhost:9090/a.jpg":             false,
+		"ftp://images.example.com/a.jpg":          false,
+		"file:///etc/passwd":                      false,
+		"http://169.254.169.254/latest/meta-data": false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sourceAllowed(u); got != want {
+			t.Errorf("%s got %v, want %v", raw, got, want)
+		}
+	}
+}
+
+func Test_downloadSource(t *testing.T) {
+	img := testUpload(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/img.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "/fake.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not a png"))
+		case "/slow.png":
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img)
+		case "/redirect":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		case "/local":
+			http.Redirect(w, r, "/img.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	defer func(h []string, b int64, p int, d time.Duration) {
+		SourceHosts, MaxSourceBytes, MaxSourcePixels, SourceTimeout = h, b, p, d
+	}(SourceHosts, MaxSourceBytes, MaxSourcePixels, SourceTimeout)
+	SourceHosts = []string{"127.0.0.1"}
+	SourceTimeout = 100 * time.Millisecond
+
+	for _, path := range []string{"/img.png", "/local"} {
+		m, err := downloadSource(context.Background(), origin.URL+path)
+		if err != nil {
+			t.Fatalf("%s got %s", path, err)
+		}
+		if got, want := m.Bounds().Dx(), 60; got != want {
+			t.Errorf("%s width got %d, want %d", path, got, want)
+		}
+	}
+
+	for _, test := range []struct {
+		url  string
+		code string
+	}{
+		{"not a url", CodeInvalidSource},
+		{"http://example.com/img.png", CodeInvalidSource},
+		{origin.URL + "/page.html", CodeInvalidSource},
+		{origin.URL + "/fake.png", CodeInvalidSource},
+		{origin.URL + "/redirect", CodeInvalidSource},
+		{origin.URL + "/missing.png", CodeSourceUnavailable},
+		{origin.URL + "/slow.png", CodeSourceUnavailable},
+	} {
+		_, err := downloadSource(context.Background(), test.url)
+		if e, ok := err.(*apiError); !ok || e.Code != test.code {
+			t.Errorf("%s got %v, want %s", test.url, err, test.code)
+		}
+	}
+
+	// Limits on the image's size.
+	MaxSourceBytes = int64(len(img) - 1)
+	if _, err := downloadSource(context.Background(), origin.URL+"/img.png"); err == nil {
+		t.Errorf("want an error for too many bytes")
+	}
+	MaxSourceBytes = int64(len(img))
+	MaxSourcePixels = 60*40 - 1
+	if _, err := downloadSource(context.Background(), origin.URL+"/img.png"); err == nil {
+		t.Errorf("want an error for too many pixels")
+	}
+}
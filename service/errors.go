@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes tell clients why a request failed without parsing the reason.
+const (
+	// CodeInvalidParam is a missing or invalid request param.
+	CodeInvalidParam = "invalid_param"
+	// CodeInvalidUpload is a missing or unreadable image upload.
+	CodeInvalidUpload = "invalid_upload"
+	// CodeNotFound is a mosaic that doesn't exist.
+	CodeNotFound = "not_found"
+	// CodeNotReady is a mosaic image that hasn't been created.
+	CodeNotReady = "not_ready"
+	// CodeMethodNotAllowed is a request with the wrong HTTP method.
+	CodeMethodNotAllowed = "method_not_allowed"
+	// CodeInvalidSource is a src_url that isn't allowed or isn't an image.
+	CodeInvalidSource = "invalid_source"
+	// CodeSourceUnavailable is a src_url that couldn't be downloaded.
+	CodeSourceUnavailable = "source_unavailable"
+	// CodeQueueFull is a mosaic refused because too many are waiting.
+	CodeQueueFull = "queue_full"
+	// CodeBusy is a rendition refused because too many are being rendered.
+	CodeBusy = "busy"
+	// CodeInternal is a failure of the server.
+	CodeInternal = "internal"
+)
+
+// apiError is a failed request, reported to the client as an errorRes.
+type apiError struct {
+	Status int
+	Code   string
+	Reason string
+	// RetryAfter, if set, tells the client when to try again.
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return e.Reason
+}
+
+func errInvalidParam(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, CodeInvalidParam, fmt.Sprintf(format, args...), 0}
+}
+
+func errMissingParam(name string) error {
+	return errInvalidParam("missing '%s' param", name)
+}
+
+func errInvalidUpload(reason string) error {
+	return &apiError{http.StatusBadRequest, CodeInvalidUpload, reason, 0}
+}
+
+func errInvalidSource(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, CodeInvalidSource, fmt.Sprintf(format, args...), 0}
+}
+
+func errSourceUnavailable(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadGateway, CodeSourceUnavailable, fmt.Sprintf(format, args...), 0}
+}
+
+func errNotFound(id string) error {
+	return &apiError{http.StatusNotFound, CodeNotFound, fmt.Sprintf("no mosaic %s", id), 0}
+}
+
+func errNotReady(m *mosaicRecord) error {
+	return &apiError{http.StatusConflict, CodeNotReady, fmt.Sprintf("mosaic %s is %s", m.ID, m.Status), 0}
+}
+
+func errQueueFullRetry() error {
+	return &apiError{http.StatusServiceUnavailable, CodeQueueFull, errQueueFull.Error(), QueueRetryAfter}
+}
+
+func errRenderBusy() error {
+	return &apiError{http.StatusServiceUnavailable, CodeBusy, "too many images are being rendered", RenderRetryAfter}
+}
+
+// handler is an http.Handler that returns an error instead of responding
+// when a request fails.
+type handler func(w http.ResponseWriter, r *http.Request) error
+
+func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		respondErr(w, err)
+	}
+}
+
+// methods routes a request to the handler for its method. HEAD is routed to
+// GET.
+type methods map[string]handler
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	h, ok := m[method]
+	if !ok {
+		allow := make([]string, 0, len(m))
+		for method := range m {
+			allow = append(allow, method)
+		}
+		sort.Strings(allow)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		respondErr(w, &apiError{http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method), 0})
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+type errorRes struct {
+	OK     bool   `json:"ok"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+func respondOK(w http.ResponseWriter, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// respondErr reports an error to the client. Errors that aren't an apiError
+// are internal.
+func respondErr(w http.ResponseWriter, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		log.Printf("Internal error: %s\n", err)
+		e = &apiError{http.StatusInternalServerError, CodeInternal, err.Error(), 0}
+	}
+	js, err := json.Marshal(errorRes{false, e.Code, e.Reason})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter/time.Second)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	w.Write(js)
+}
@@ -1,41 +1,42 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"image"
-	"image/jpeg"
-	// To encode/decode png
-	_ "image/png"
+	"image/color/palette"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"time"
 
 	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
 	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
 )
 
 func init() {
-	http.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			handleAddTagToInventory(w, r)
-			return
-		}
-		handleGetInventory(w, r)
+	http.Handle("/inventory", methods{
+		"GET":  handleGetInventory,
+		"POST": handleAddTagToInventory,
 	})
-	http.HandleFunc("/mosaics/img", handleRenderMosaic)
-	http.HandleFunc("/mosaics", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			handleCreateMosaic(w, r)
-			return
-		}
-		if r.FormValue("id") != "" {
-			handleGetMosaic(w, r)
-			return
-		}
-		handleListMosaics(w, r)
-
+	http.Handle("/mosaics/img", methods{"GET": handleRenderMosaic})
+	http.Handle("/mosaics/events", methods{"GET": handleMosaicEvents})
+	http.Handle("/mosaics/cancel", methods{"POST": handleCancelMosaic})
+	http.Handle("/mosaics", methods{
+		"GET": func(w http.ResponseWriter, r *http.Request) error {
+			if r.FormValue("id") != "" {
+				return handleGetMosaic(w, r)
+			}
+			return handleListMosaics(w, r)
+		},
+		"POST":   handleCreateMosaic,
+		"DELETE": handleDeleteMosaic,
 	})
 }
 
@@ -45,6 +46,9 @@ var thumbs *thumbInventory
 // mosaics is the database of mosaics generated.
 var mosaics *mosaicInventory
 
+// queue holds the mosaics waiting to be generated.
+var queue *jobQueue
+
 var (
 	// HostPort is where the server runs.
 	HostPort = ":8080"
@@ -52,6 +56,16 @@ var (
 	MosaicsDir = "./images/mosaics"
 	// ThumbsDir is where the server stores thumbs.
 	ThumbsDir = "./images/thumbs"
+	// ThumbsCache, if set, creates the cache for a tag's thumbs instead of
+	// storing them in ThumbsDir.
+	ThumbsCache func(tag string) mosaic.ImageCache
+	// ThumbsTags lists the tags stored by ThumbsCache, so that they're
+	// pruned with the others. Only used with ThumbsCache, the tags in
+	// ThumbsDir are found by listing it.
+	ThumbsTags func() ([]string, error)
+	// Instagram, if set, is the client used to fetch thumbs. Defaults to
+	// instagram.NewClient().
+	Instagram instagram.Client
 )
 
 // Serve starts up a server. It initializes thumb and mosaic on-disk storage
@@ -63,37 +77,91 @@ func Serve() {
 	if err := os.MkdirAll(ThumbsDir, 0755); err != nil {
 		log.Fatalf("Failed to create thumbs dir: %s\n", err)
 	}
-	mosaics = &mosaicInventory{
-		cache: mosaic.NewFileImageCache(MosaicsDir),
+	var err error
+	mosaics, err = newMosaicInventory(
+		mosaic.NewFileImageCacheWithOptions(MosaicsDir, mosaic.FileCacheOptions{Sync: true}),
+		path.Join(MosaicsDir, "records"),
+		path.Join(MosaicsDir, "files"),
+	)
+	if err != nil {
+		log.Fatalf("Failed to load mosaics: %s\n", err)
+	}
+	api := Instagram
+	if api == nil {
+		api = instagram.NewClient()
 	}
 	thumbs = &thumbInventory{
-		tagCacheFunc: func(tag string) mosaic.ImageCache {
+		tagCacheFunc: func(tag string) (mosaic.ImageCache, error) {
+			if !validTag(tag) {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			if ThumbsCache != nil {
+				return ThumbsCache(tag), nil
+			}
 			path := path.Join(ThumbsDir, tag)
 			if err := os.MkdirAll(path, 0755); err != nil {
-				log.Fatalf("Failed to create cache dir: %s\n", err)
+				return nil, err
 			}
-			return mosaic.NewFileImageCache(path)
+			return mosaic.NewFileImageCache(path), nil
 		},
-		api:    instagram.NewClient(),
+		api:    api,
+		tags:   storedTags,
 		images: make(map[string]*mosaic.ImageInventory),
 		states: make(map[string]chan bool),
 	}
+	queue = newJobQueue(MosaicWorkers, QueueDepth, runMosaic)
+	resumeMosaics()
+	if MosaicRetention > 0 {
+		go expireMosaics()
+	}
 
 	log.Fatal(http.ListenAndServe(HostPort, nil))
 }
 
+// storedTags lists the tags that have thumbs, from ThumbsTags if they're in
+// ThumbsCache or else the dirs in ThumbsDir.
+func storedTags() ([]string, error) {
+	if ThumbsCache != nil {
+		if ThumbsTags == nil {
+			return nil, nil
+		}
+		return ThumbsTags()
+	}
+	infos, err := ioutil.ReadDir(ThumbsDir)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, info := range infos {
+		if info.IsDir() {
+			tags = append(tags, info.Name())
+		}
+	}
+	return tags, nil
+}
+
 // GET /mosaics
 // List all mosaics that have been created.
 
 func newMosaicRes(m *mosaicRecord) *mosaicRes {
-	return &mosaicRes{
-		OK:     true,
-		ID:     string(m.ID),
-		Tag:    m.Tag,
-		Status: m.Status,
-		URL:    fmt.Sprintf("/mosaics?id=%s", m.ID),
-		ImgURL: fmt.Sprintf("/mosaics/img?id=%s", m.ID),
+	res := &mosaicRes{
+		OK:       true,
+		ID:       string(m.ID),
+		Tag:      m.Tag,
+		Status:   m.Status,
+		Params:   m.Params,
+		Created:  m.Created,
+		Updated:  m.Updated,
+		Reason:   m.Reason,
+		Stage:    m.Stage,
+		Progress: m.Progress,
+		URL:      fmt.Sprintf("/mosaics?id=%s", m.ID),
+		ImgURL:   fmt.Sprintf("/mosaics/img?id=%s", m.ID),
+	}
+	if m.Status == MosaicStatusQueued {
+		res.Position = queue.Position(m.ID)
 	}
+	return res
 }
 
 type mosaicsListRes struct {
@@ -102,86 +170,241 @@ type mosaicsListRes struct {
 }
 
 type mosaicRes struct {
-	OK     bool   `json:"ok"`
-	ID     string `json:"id"`
-	Tag    string `json:"tag"`
-	Status string `json:"status"`
-	URL    string `json:"url"`
-	ImgURL string `json:"img"`
+	OK       bool         `json:"ok"`
+	ID       string       `json:"id"`
+	Tag      string       `json:"tag"`
+	Status   string       `json:"status"`
+	Params   mosaicParams `json:"params"`
+	Created  time.Time    `json:"created"`
+	Updated  time.Time    `json:"updated"`
+	Reason   string       `json:"reason,omitempty"`
+	Stage    string       `json:"stage,omitempty"`
+	Progress int          `json:"progress"`
+	// Position is the place in line of a queued mosaic, starting at 1.
+	Position int             `json:"position,omitempty"`
+	URL      string          `json:"url"`
+	ImgURL   string          `json:"img"`
+	Credits  []mosaic.Credit `json:"credits,omitempty"`
+	// Deliveries are the attempts to post the mosaic to its callback_url.
+	Deliveries []callbackDelivery `json:"deliveries,omitempty"`
 }
 
-func handleListMosaics(w http.ResponseWriter, r *http.Request) {
+func handleListMosaics(w http.ResponseWriter, r *http.Request) error {
+	list := mosaics.List()
 	res := &mosaicsListRes{
 		true,
-		make([]*mosaicRes, mosaics.Size()),
+		make([]*mosaicRes, len(list)),
 	}
-	for i, m := range mosaics.List() {
+	for i, m := range list {
 		res.Mosaics[i] = newMosaicRes(m)
 	}
 	respondOK(w, res)
+	return nil
 }
 
 // POST /mosaics?tag=<tag> img=<FILE>
-// Create a new mosaic.
+// POST /mosaics?tag=<tag>&src_url=<url>
+// [&units=<n>][&unitSize=<px>][&shrink=<0-1>][&paletteSize=<n>]
+// [&solid=true][&crop=square|fit][&format=jpeg|png][&callback_url=<url>]
+// Create a new mosaic from an uploaded image, or one downloaded from a host
+// allowed by SourceHosts. The tag is not needed for a solid mosaic, and may
+// name a popular or location inventory from POST /inventory. If
+// callback_url is given, the mosaic is posted to it when it's created or
+// fails.
 
 var (
 	// Units is how many mosaic units to use for width and height.
 	Units = 40
 	// UnitSize is how big the thumbnail images are, width and height.
-	UnitSize    = 150
-	paletteSize = 256
+	UnitSize = 150
+	// PaletteSize is how many colors are in the palette.
+	PaletteSize = 256
+
+	// MosaicWorkers is how many mosaics are generated at once.
+	MosaicWorkers = 2
+	// QueueDepth is how many mosaics may wait to be generated. Requests for
+	// more are refused with 503 Service Unavailable.
+	QueueDepth = 20
+	// QueueRetryAfter is how long clients are told to wait when the queue
+	// is full.
+	QueueRetryAfter = 30 * time.Second
 )
 
-func handleCreateMosaic(w http.ResponseWriter, r *http.Request) {
+func handleCreateMosaic(w http.ResponseWriter, r *http.Request) error {
+	// Read params.
+	params, err := mosaicParamsFromRequest(r)
+	if err != nil {
+		return err
+	}
+
 	// Read tag.
-	tag := r.FormValue("tag")
-	if tag == "" {
-		respondErr(w, http.StatusBadRequest, "missing 'tag' param")
-		return
+	tag, err := requestTag(r)
+	if err != nil {
+		return err
+	}
+	if tag == "" && !params.Solid {
+		return errMissingParam("tag")
+	}
+
+	// Read where to post the mosaic when it's done.
+	if params.CallbackURL, err = requestCallback(r); err != nil {
+		return err
+	}
+
+	// Read the image, uploaded or from a URL.
+	in, err := requestImage(r)
+	if err != nil {
+		return err
+	}
+	params.SourceURL = r.FormValue("src_url")
+
+	// Refuse the mosaic if there's no room to generate it.
+	if queue.Full() {
+		return errQueueFullRetry()
+	}
+
+	// Begin fetching thumbs while the mosaic waits in the queue.
+	if !params.Solid {
+		if _, err := thumbs.AddNamed(tag); err != nil {
+			return err
+		}
+	}
+
+	// Create a record to track the mosaic, and keep the upload until it's
+	// generated.
+	m, err := mosaics.Create(tag, params)
+	if err != nil {
+		return err
+	}
+	if err := mosaics.StoreUpload(m.ID, in); err != nil {
+		abortMosaic(m.ID, "storing upload: "+err.Error())
+		return err
 	}
-	ch := thumbs.AddTag(tag)
 
-	// Read image upload.
+	// Generate mosaic offline.
+	if err := mosaics.SetStatus(m.ID, MosaicStatusQueued); err != nil {
+		return err
+	}
+	if err := queue.Push(m.ID); err != nil {
+		abortMosaic(m.ID, err.Error())
+		if err := mosaics.DeleteUpload(m.ID); err != nil {
+			log.Printf("Failed to delete mosaic upload: %s\n", err)
+		}
+		return errQueueFullRetry()
+	}
+
+	// Respond immediately.
+	if m, err = mosaics.Get(m.ID); err != nil {
+		return err
+	}
+	res := newMosaicRes(m)
+	respondOK(w, res)
+	return nil
+}
+
+// requestImage reads the image uploaded as img, or downloads it from src_url.
+func requestImage(r *http.Request) (image.Image, error) {
 	fi, _, err := r.FormFile("img")
+	if src := r.FormValue("src_url"); src != "" {
+		if err == nil {
+			fi.Close()
+			return nil, errInvalidParam("use 'img' or 'src_url', not both")
+		}
+		return downloadSource(r.Context(), src)
+	}
+	if err == http.ErrMissingFile {
+		return nil, errInvalidUpload("missing 'img' upload or 'src_url' param")
+	}
 	if err != nil {
-		respondErr(w, http.StatusBadRequest, "upload failed")
+		return nil, errInvalidUpload("upload failed: " + err.Error())
 	}
 	defer fi.Close()
 	in, _, err := image.Decode(fi)
 	if err != nil {
-		respondErr(w, http.StatusBadRequest, "image parsing failed")
+		return nil, errInvalidUpload("image parsing failed: " + err.Error())
 	}
+	return in, nil
+}
+
+// resumeMosaics queues the mosaics that were waiting or being generated when
+// the service stopped. Those whose upload is gone can't be generated.
+func resumeMosaics() {
+	for _, m := range mosaics.Unfinished() {
+		if _, err := mosaics.GetUpload(m.ID); err != nil {
+			failMosaic(m.ID, "interrupted by a restart")
+			sendCallback(m.ID)
+			continue
+		}
+		if err := mosaics.SetStatus(m.ID, MosaicStatusQueued); err != nil {
+			log.Printf("Failed to resume mosaic %s: %s\n", m.ID, err)
+			continue
+		}
+		log.Printf("Mosaic[%s] Resumed\n", m.ID)
+		queue.Resume(m.ID)
+	}
+}
 
-	// Create a record to track the mosaic.
-	m, err := mosaics.Create(tag)
+// runMosaic generates a queued mosaic once its tag has been fetched, then
+// sends its callback.
+func runMosaic(ctx context.Context, id mosaicID) {
+	m, err := mosaics.Get(id)
+	if err != nil || m == nil {
+		log.Printf("Failed to get mosaic %s: %v\n", id, err)
+		return
+	}
+	if m.Done() {
+		return
+	}
+	defer sendCallback(id)
+	defer func() {
+		if err := mosaics.DeleteUpload(id); err != nil {
+			log.Printf("Failed to delete mosaic upload: %s\n", err)
+		}
+	}()
+	in, err := mosaics.GetUpload(id)
 	if err != nil {
-		respondErr(w, http.StatusBadRequest, "failed to create record")
+		failMosaic(id, "reading upload: "+err.Error())
 		return
 	}
-
-	// Generate mosaic offline.
-	go func() {
+	if !m.Params.Solid {
+		done, err := thumbs.AddNamed(m.Tag)
+		if err != nil {
+			failMosaic(id, "fetching thumbs: "+err.Error())
+			return
+		}
 		log.Printf("Waiting for tags...\n")
-		<-ch
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Printf("Mosaic[%s] Cancelled\n", id)
+			return
+		}
 		log.Printf("Tags are ready...\n")
-		generateMosaic(tag, in, m)
-	}()
-
-	// Respond immediately.
-	res := newMosaicRes(m)
-	respondOK(w, res)
+	}
+	generateMosaic(ctx, m.Tag, in, m)
 }
 
-func generateMosaic(tag string, in image.Image, m *mosaicRecord) {
+// generateMosaic makes the mosaic and stores it. It stops if ctx is
+// cancelled, leaving the status to whoever cancelled it.
+func generateMosaic(ctx context.Context, tag string, in image.Image, m *mosaicRecord) {
+	params := m.Params.withDefaults()
+	progress := mosaicProgress(m.ID)
 
 	// First build a color palette.
 	log.Printf("Mosaic[%s] Create Palette...", m.ID)
-	p := mosaic.NewImagePalette(paletteSize)
-	if err := thumbs.PopulatePalette(tag, p); err != nil {
-		log.Printf("Failed to populate palette: %s", err)
-		if err := mosaics.SetStatus(m.ID, MosaicStatusFailed); err != nil {
-			log.Printf("Failed to set mosaic failed: %s", err)
+	var p *mosaic.ImagePalette
+	if params.Solid {
+		p = mosaic.NewSolidPalette(palette.WebSafe)
+	} else {
+		p = mosaic.NewImagePalette(params.PaletteSize)
+		if err := thumbs.PopulatePalette(tag, p, progress); err != nil {
+			log.Printf("Failed to populate palette: %s", err)
+			failMosaic(m.ID, "populating palette: "+err.Error())
+			return
 		}
+	}
+	if p.NumColors() == 0 {
+		failMosaic(m.ID, "no images are available")
 		return
 	}
 	log.Printf("Mosaic[%s] Create Palette Done with %d colors, %d images.", m.ID, p.NumColors(), p.NumImages())
@@ -194,88 +417,473 @@ func generateMosaic(tag string, in image.Image, m *mosaicRecord) {
 
 	// Generate the mosaic.
 	log.Printf("Mosaic[%s] Compose...", m.ID)
-	out := mosaic.ComposeSquare(in, Units, UnitSize, p)
+	var mos mosaic.Mosaic
+	if params.Crop == CropFit {
+		mos = mosaic.NewFitMosaic(in, params.Units, params.UnitSize)
+	} else {
+		mos = mosaic.NewSquareMosaic(in, params.Units, params.UnitSize)
+	}
+	mos.Progress = progress
+	out, err := mos.ComposeContext(ctx, p)
+	if err != nil {
+		log.Printf("Mosaic[%s] Cancelled\n", m.ID)
+		return
+	}
+	if params.Shrink < 1 {
+		out = mosaic.Shrink(out, params.Shrink)
+	}
 	log.Printf("Mosaic[%s] Compose Done.", m.ID)
 
+	// Credit the photographers.
+	if !params.Solid {
+		credits, err := thumbs.Credits(tag, p)
+		if err != nil {
+			log.Printf("Failed to get mosaic credits: %s", err)
+		}
+		if err := thumbs.RecordUse(tag, p); err != nil {
+			log.Printf("Failed to record thumb use: %s", err)
+		}
+		if err := mosaics.SetCredits(m.ID, credits); err != nil {
+			log.Printf("Failed to set mosaic credits: %s", err)
+		}
+	}
+
 	// Store the image and update the the mosaic is done.
-	if err := mosaics.StoreImage(m.ID, out); err != nil {
+	if ctx.Err() != nil {
+		log.Printf("Mosaic[%s] Cancelled\n", m.ID)
+		return
+	}
+	progress(mosaic.StageEncode, 0, 1)
+	data, err := encodeImage(out, params.Format)
+	if err != nil {
+		log.Printf("Failed to encode mosaic image: %s", err)
+		failMosaic(m.ID, "encoding image: "+err.Error())
+		return
+	}
+	// Encoding may take a while, so check again that the mosaic is wanted.
+	if ctx.Err() != nil {
+		log.Printf("Mosaic[%s] Cancelled\n", m.ID)
+		return
+	}
+	if err := mosaics.StoreImage(m.ID, rendition{}.File(params.Format), data); err != nil {
 		log.Printf("Failed to store mosaic image: %s", err)
+		failMosaic(m.ID, "storing image: "+err.Error())
 		return
 	}
+	progress(mosaic.StageEncode, 1, 1)
 	if err := mosaics.SetStatus(m.ID, MosaicStatusCreated); err != nil {
 		log.Printf("Failed to set mosaic created: %s", err)
 		return
 	}
 }
 
+// progressStages are the share of a mosaic's progress given to each stage, as
+// the percent done when it starts and ends.
+var progressStages = map[string][2]int{
+	mosaic.StagePalette: {0, 30},
+	mosaic.StageCompose: {30, 90},
+	mosaic.StageEncode:  {90, 100},
+}
+
+// mosaicProgress records the progress of generating a mosaic as a percent.
+func mosaicProgress(id mosaicID) mosaic.ProgressFunc {
+	return func(stage string, done, total int) {
+		span := progressStages[stage]
+		percent := span[0]
+		if total > 0 {
+			percent += (span[1] - span[0]) * done / total
+		}
+		if err := mosaics.SetProgress(id, stage, percent); err != nil {
+			log.Printf("Failed to set mosaic progress: %s", err)
+		}
+	}
+}
+
+// failMosaic records why a mosaic could not be generated.
+func failMosaic(id mosaicID, reason string) {
+	if err := mosaics.Fail(id, reason); err != nil {
+		log.Printf("Failed to set mosaic failed: %s", err)
+	}
+}
+
+// abortMosaic fails a mosaic that couldn't be queued, and sends its callback
+// like runMosaic does for one that fails.
+func abortMosaic(id mosaicID, reason string) {
+	failMosaic(id, reason)
+	sendCallback(id)
+}
+
 // GET /mosaics?id=<id>
-// Get information about a mosaic.
+// Get information about a mosaic, including credits for the thumbs it uses
+// and the attempts to deliver its callback.
 
-func handleGetMosaic(w http.ResponseWriter, r *http.Request) {
-	// Read id.
+func handleGetMosaic(w http.ResponseWriter, r *http.Request) error {
+	m, err := requestMosaic(r)
+	if err != nil {
+		return err
+	}
+	res := newMosaicRes(m)
+	res.Credits = m.Credits
+	res.Deliveries = m.Deliveries
+	respondOK(w, res)
+	return nil
+}
+
+// requestMosaic returns the mosaic named by the request's id param.
+func requestMosaic(r *http.Request) (*mosaicRecord, error) {
 	id := r.FormValue("id")
 	if id == "" {
-		respondErr(w, http.StatusBadRequest, "missing 'id' param")
-		return
+		return nil, errMissingParam("id")
 	}
 	m, err := mosaics.Get(mosaicID(id))
 	if err != nil {
-		respondErr(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 	if m == nil {
-		http.NotFound(w, r)
-		return
+		return nil, errNotFound(id)
 	}
-	res := newMosaicRes(m)
-	respondOK(w, res)
+	return m, nil
 }
 
-// GET /mosaics/img?id=<id>
-// Get a mosaic image that was created.
+// GET /mosaics/events?id=<id>
+// Stream the mosaic as Server-Sent Events each time its status or progress
+// changes. The stream ends when the mosaic is done.
+
+// eventsHeartbeat is how often a comment is sent to keep an idle stream open.
+var eventsHeartbeat = 15 * time.Second
 
-func handleRenderMosaic(w http.ResponseWriter, r *http.Request) {
+func handleMosaicEvents(w http.ResponseWriter, r *http.Request) error {
 	// Read id.
 	id := r.FormValue("id")
 	if id == "" {
-		respondErr(w, http.StatusBadRequest, "missing 'id' param")
-		return
+		return errMissingParam("id")
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming unsupported")
 	}
-	img, err := mosaics.GetImage(mosaicID(id))
+
+	// Watch before reading the record so that no change is missed.
+	changes, stop := mosaics.Watch(mosaicID(id))
+	defer stop()
+	m, err := requestMosaic(r)
 	if err != nil {
-		respondErr(w, http.StatusInternalServerError, "getting image")
+		return err
 	}
-	if img == nil {
-		http.NotFound(w, r)
-		return
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(m *mosaicRecord) error {
+		js, err := json.Marshal(newMosaicRes(m))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: mosaic\ndata: %s\n\n", js); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	// Once the stream has begun, errors can only be logged.
+	if err := send(m); err != nil {
+		log.Printf("Failed to send mosaic event: %s\n", err)
+		return nil
+	}
+	for !m.Done() {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-heartbeat.C:
+			_, err = fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case c := <-changes:
+			m = &c
+			err = send(m)
+		}
+		if err != nil {
+			log.Printf("Failed to send mosaic event: %s\n", err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// POST /mosaics/cancel?id=<id>
+// Stop generating a mosaic. Its record is kept with the cancelled status.
+
+func handleCancelMosaic(w http.ResponseWriter, r *http.Request) error {
+	m, err := requestMosaic(r)
+	if err != nil {
+		return err
+	}
+	if m, err = cancelMosaic(m.ID); err != nil {
+		return err
+	}
+	respondOK(w, newMosaicRes(m))
+	return nil
+}
+
+// DELETE /mosaics?id=<id>
+// Stop generating a mosaic, and remove its image and record.
+
+func handleDeleteMosaic(w http.ResponseWriter, r *http.Request) error {
+	m, err := requestMosaic(r)
+	if err != nil {
+		return err
+	}
+	if m, err = cancelMosaic(m.ID); err != nil {
+		return err
+	}
+	if err := mosaics.Delete(m.ID); err != nil {
+		return err
+	}
+	respondOK(w, newMosaicRes(m))
+	return nil
+}
+
+// cancelMosaic stops the mosaic's job and marks it cancelled, unless it's
+// done. It returns the updated record.
+func cancelMosaic(id mosaicID) (*mosaicRecord, error) {
+	queue.Cancel(id)
+	if err := mosaics.Cancel(id); err != nil {
+		return nil, err
+	}
+	log.Printf("Mosaic[%s] Cancel\n", id)
+	return mosaics.Get(id)
+}
+
+// MosaicRetention, if set, is how long mosaics are kept after they're created.
+var MosaicRetention time.Duration
+
+// expireMosaics deletes mosaics older than MosaicRetention, checking
+// periodically.
+func expireMosaics() {
+	interval := MosaicRetention / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	for range time.Tick(interval) {
+		deleteExpiredMosaics()
+	}
+}
+
+// deleteExpiredMosaics deletes mosaics older than MosaicRetention.
+func deleteExpiredMosaics() {
+	for _, m := range mosaics.Expired(time.Now().Add(-MosaicRetention)) {
+		if err := mosaics.Delete(m.ID); err != nil {
+			log.Printf("Failed to expire mosaic %s: %s\n", m.ID, err)
+			continue
+		}
+		log.Printf("Mosaic[%s] Expired\n", m.ID)
+	}
+}
+
+// GET /mosaics/img?id=<id>[&size=thumbnail|preview|full]
+// [&width=<px>][&height=<px>][&fit=contain|cover][&region=<x>,<y>,<w>,<h>]
+// Get a mosaic image that was created. It may be cropped to a region of the
+// full image, then scaled down to fit within a size. Renditions other than
+// the full image are stored so that they're only made once. Images don't
+// change once they're stored, so they're served with validators and may be
+// requested by range.
+
+// ImageMaxAge is how long clients and CDNs may cache a mosaic image. It's no
+// longer than the mosaic has left before MosaicRetention expires it.
+var ImageMaxAge = 24 * time.Hour
+
+func handleRenderMosaic(w http.ResponseWriter, r *http.Request) error {
+	m, err := requestMosaic(r)
+	if err != nil {
+		return err
+	}
+	rend, err := renditionFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if m.Status != MosaicStatusCreated {
+		return errNotReady(m)
+	}
+	content, modTime, err := openMosaicImage(m, rend)
+	if err != nil {
+		return err
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	// The id is unique and the image never changes, so it can be the ETag.
+	format := m.Params.withDefaults().Format
+	name := rend.File(format)
+	maxAge := ImageMaxAge
+	if MosaicRetention > 0 {
+		if left := time.Until(m.Created.Add(MosaicRetention)); left < maxAge {
+			maxAge = left
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
 	}
-	err = jpeg.Encode(w, img, nil)
+	w.Header().Set("Content-Type", contentType(format))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%s"`, m.ID, name))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second)))
+	http.ServeContent(w, r, name, modTime, content)
+	return nil
+}
+
+// openMosaicImage opens the encoded rendition of a mosaic image, making and
+// storing it if it hasn't been. Close the content if it's an io.Closer.
+func openMosaicImage(m *mosaicRecord, rend rendition) (io.ReadSeeker, time.Time, error) {
+	format := m.Params.withDefaults().Format
+	name := rend.File(format)
+	fi, err := mosaics.OpenImage(m.ID, name)
+	if err == nil {
+		info, err := fi.Stat()
+		if err != nil {
+			fi.Close()
+			return nil, time.Time{}, err
+		}
+		return fi, info.ModTime(), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, time.Time{}, err
+	}
+
+	// Renditions past MaxRenditions are made for every request, so limit
+	// how many are made at once.
+	if !rend.IsFull() {
+		if !startRender() {
+			return nil, time.Time{}, errRenderBusy()
+		}
+		defer finishRender()
+	}
+	img, err := renderMosaic(m, rend)
 	if err != nil {
-		respondErr(w, http.StatusInternalServerError, "writing jpeg")
+		return nil, time.Time{}, err
 	}
-	w.Header().Set("Content-Type", "image/jpg")
+	data, err := encodeImage(img, format)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if rend.IsFull() {
+		err = mosaics.StoreImage(m.ID, name, data)
+	} else {
+		_, err = mosaics.StoreRendition(m.ID, name, data)
+	}
+	if err != nil {
+		log.Printf("Failed to store mosaic image: %s\n", err)
+	}
+	return bytes.NewReader(data), time.Now(), nil
+}
+
+// renderMosaic makes a rendition of a mosaic image from the full image.
+func renderMosaic(m *mosaicRecord, rend rendition) (image.Image, error) {
+	if rend.IsFull() {
+		// Mosaics created before images were stored encoded are in the
+		// cache.
+		img, err := mosaics.GetCachedImage(m.ID)
+		if mosaic.IsNotCached(err) {
+			return nil, errNotReady(m)
+		}
+		return img, err
+	}
+	content, _, err := openMosaicImage(m, rendition{})
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+	full, _, err := image.Decode(content)
+	if err != nil {
+		return nil, err
+	}
+	return rend.Render(full)
 }
 
 // POST /inventory?tag=<tag>
-// Add images to the thumbnails inventory.
+// POST /inventory?popular=1
+// POST /inventory?lat=<lat>&lng=<lng>[&distance=<meters>][&min_timestamp=<unix>][&max_timestamp=<unix>]
+// Add images to the thumbnails inventory, by tag, from the popular images, or
+// posted near a location. The response names the inventory to use as the tag
+// when creating mosaics.
 
 var (
 	fetchImages = 100
 )
 
 type inventoryReq struct {
-	OK bool `json:"ok"`
+	OK  bool   `json:"ok"`
+	Tag string `json:"tag"`
 }
 
-func handleAddTagToInventory(w http.ResponseWriter, r *http.Request) {
-	tag := r.FormValue("tag")
-	if tag == "" {
-		respondErr(w, http.StatusBadRequest, "missing 'tag' param")
-		return
+func handleAddTagToInventory(w http.ResponseWriter, r *http.Request) error {
+	tag, err := requestTag(r)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tag != "":
+		_, err = thumbs.AddNamed(tag)
+	case r.FormValue("popular") != "":
+		tag = PopularTag
+		_, err = thumbs.AddPopular()
+	case r.FormValue("lat") != "" || r.FormValue("lng") != "":
+		var q instagram.LocationQuery
+		if q, err = locationQuery(r); err != nil {
+			return err
+		}
+		tag = LocationTag(q)
+		_, err = thumbs.AddLocation(q)
+	default:
+		return errInvalidParam("missing 'tag', 'popular' or 'lat' and 'lng' params")
 	}
-	thumbs.AddTag(tag)
-	res := &inventoryReq{true}
+	if err != nil {
+		return err
+	}
+	res := &inventoryReq{true, tag}
 	respondOK(w, res)
+	return nil
+}
+
+// locationQuery reads the location params of a request.
+func locationQuery(r *http.Request) (instagram.LocationQuery, error) {
+	q := instagram.LocationQuery{
+		Lat: r.FormValue("lat"),
+		Lng: r.FormValue("lng"),
+	}
+	if _, err := strconv.ParseFloat(q.Lat, 64); err != nil {
+		return q, errInvalidParam("invalid 'lat' param")
+	}
+	if _, err := strconv.ParseFloat(q.Lng, 64); err != nil {
+		return q, errInvalidParam("invalid 'lng' param")
+	}
+	if v := r.FormValue("distance"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 {
+			return q, errInvalidParam("invalid 'distance' param")
+		}
+		q.Distance = d
+	}
+	for name, t := range map[string]*time.Time{
+		"min_timestamp": &q.MinTime,
+		"max_timestamp": &q.MaxTime,
+	} {
+		if v := r.FormValue(name); v != "" {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return q, errInvalidParam("invalid '%s' param", name)
+			}
+			*t = time.Unix(secs, 0)
+		}
+	}
+	return q, nil
 }
 
 // GET /inventory
@@ -292,7 +900,7 @@ type inventoryImageRes struct {
 	Count int    `json:"count"`
 }
 
-func handleGetInventory(w http.ResponseWriter, r *http.Request) {
+func handleGetInventory(w http.ResponseWriter, r *http.Request) error {
 	res := &inventoryRes{
 		true,
 		make([]inventoryImageRes, 0),
@@ -304,33 +912,5 @@ func handleGetInventory(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	respondOK(w, res)
-}
-
-// Utils
-
-type errorRes struct {
-	OK     bool   `json:"ok"`
-	Reason string `json:"reason"`
-}
-
-func respondOK(w http.ResponseWriter, data interface{}) {
-	js, err := json.Marshal(data)
-	if err != nil {
-		respondErr(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-}
-
-func respondErr(w http.ResponseWriter, code int, msg string) {
-	data := errorRes{false, msg}
-	js, err := json.Marshal(data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(js)
+	return nil
 }
@@ -0,0 +1,681 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
+	"github.com/rcarver/golang-challenge-3-mosaic/instagram/instagramtest"
+	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
+)
+
+// fakeAPI is the Instagram server of the current setupService.
+var fakeAPI *instagramtest.Server
+
+// setupService stores thumbs and mosaics in a temp dir, fetching thumbs from
+// the recorded Instagram fixtures. Mosaics are generated by workers, with up
+// to depth waiting. Call the returned func to clean up.
+func setupService(t *testing.T, workers, depth int) func() {
+	dir, err := ioutil.TempDir("", "service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := instagramtest.LoadFixtures("../fixtures/instagram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := instagramtest.NewServer(f)
+	fakeAPI = ts
+
+	mosaicsDir := filepath.Join(dir, "mosaics")
+	mosaics, err = newMosaicInventory(mosaic.NewFileImageCache(mosaicsDir), filepath.Join(mosaicsDir, "records"), filepath.Join(mosaicsDir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbs = &thumbInventory{
+		tagCacheFunc: func(tag string) (mosaic.ImageCache, error) {
+			path := filepath.Join(dir, "thumbs", tag)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return nil, err
+			}
+			return mosaic.NewFileImageCache(path), nil
+		},
+		api: instagram.NewClientWithOptions(instagram.ClientOptions{
+			BaseURL: ts.APIURL(),
+			Retry:   instagram.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		}),
+		images: make(map[string]*mosaic.ImageInventory),
+		states: make(map[string]chan bool),
+	}
+	queue = newJobQueue(workers, depth, runMosaic)
+	return func() {
+		// Let running jobs finish before the next test replaces the globals.
+		waitIdle(queue)
+		callbacks.Wait()
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// waitIdle waits for the queue's running jobs to finish.
+func waitIdle(q *jobQueue) {
+	for {
+		q.mu.Lock()
+		running := len(q.running)
+		q.mu.Unlock()
+		if running == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// serve handles a request with the service's routes.
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+// uploadRequest creates a mosaic from the image, if given.
+func uploadRequest(t *testing.T, query string, img []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if img != nil {
+		fw, err := mw.CreateFormFile("img", "in.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(img)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/mosaics?"+query, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// testUpload is a small PNG image.
+func testUpload(t *testing.T) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 60, 40))
+	for x := 0; x < 60; x++ {
+		for y := 0; y < 40; y++ {
+			m.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 6), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// expectErr checks that the response is an error with the status and code.
+func expectErr(t *testing.T, name string, w *httptest.ResponseRecorder, status int, code string) {
+	if got := w.Code; got != status {
+		t.Errorf("%s: status got %d, want %d", name, got, status)
+	}
+	var res errorRes
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: bad error response %q: %s", name, w.Body, err)
+	}
+	if res.OK || res.Code != code || res.Reason == "" {
+		t.Errorf("%s: got %+v, want code %s", name, res, code)
+	}
+}
+
+// decodeMosaic reads a mosaic response.
+func decodeMosaic(t *testing.T, w *httptest.ResponseRecorder) *mosaicRes {
+	if w.Code != http.StatusOK {
+		t.Fatalf("status got %d, want 200: %s", w.Code, w.Body)
+	}
+	var res mosaicRes
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return &res
+}
+
+// waitDone waits for a mosaic to be created, fail or be cancelled.
+func waitDone(t *testing.T, id string) *mosaicRecord {
+	changes, stop := mosaics.Watch(mosaicID(id))
+	defer stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		m, _ := mosaics.Get(mosaicID(id))
+		if m.Done() {
+			return m
+		}
+		select {
+		case <-changes:
+		case <-timeout:
+			t.Fatalf("timed out waiting for mosaic %s, status %s", id, m.Status)
+		}
+	}
+}
+
+func TestCreateMosaic_invalid(t *testing.T) {
+	defer setupService(t, 0, 1)()
+	img := testUpload(t)
+	for _, test := range []struct {
+		name   string
+		r      *http.Request
+		status int
+		code   string
+	}{
+		{"no tag", uploadRequest(t, "", img), 400, CodeInvalidParam},
+		{"bad units", uploadRequest(t, "tag=cat&units=0", img), 400, CodeInvalidParam},
+		{"bad tag", uploadRequest(t, "tag=..%2Fmosaics", img), 400, CodeInvalidParam},
+		{"no upload", uploadRequest(t, "tag=cat", nil), 400, CodeInvalidUpload},
+		{"not an image", uploadRequest(t, "tag=cat", []byte("nope")), 400, CodeInvalidUpload},
+		{"not multipart", httptest.NewRequest("POST", "/mosaics?tag=cat", nil), 400, CodeInvalidUpload},
+	} {
+		expectErr(t, test.name, serve(test.r), test.status, test.code)
+	}
+	if got := mosaics.Size(); got != 0 {
+		t.Errorf("got %d mosaics, want none", got)
+	}
+}
+
+func TestCreateMosaic_queued(t *testing.T) {
+	// With no workers the mosaic stays queued.
+	defer setupService(t, 0, 1)()
+	img := testUpload(t)
+
+	res := decodeMosaic(t, serve(uploadRequest(t, "solid=true", img)))
+	if res.Status != MosaicStatusQueued || res.Position != 1 {
+		t.Errorf("got status %s position %d, want queued at 1", res.Status, res.Position)
+	}
+
+	w := serve(uploadRequest(t, "solid=true", img))
+	expectErr(t, "full", w, http.StatusServiceUnavailable, CodeQueueFull)
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Errorf("want a Retry-After header")
+	}
+
+	w = serve(httptest.NewRequest("GET", res.ImgURL, nil))
+	expectErr(t, "image", w, http.StatusConflict, CodeNotReady)
+
+	w = serve(httptest.NewRequest("POST", "/mosaics/cancel?id="+res.ID, nil))
+	if got := decodeMosaic(t, w).Status; got != MosaicStatusCancelled {
+		t.Errorf("cancel got status %s, want cancelled", got)
+	}
+	if got := queue.Position(mosaicID(res.ID)); got != 0 {
+		t.Errorf("cancelled mosaic is still queued at %d", got)
+	}
+
+	w = serve(httptest.NewRequest("DELETE", res.URL, nil))
+	decodeMosaic(t, w)
+	w = serve(httptest.NewRequest("GET", res.URL, nil))
+	expectErr(t, "deleted", w, http.StatusNotFound, CodeNotFound)
+}
+
+func TestCreateMosaic_solid(t *testing.T) {
+	defer setupService(t, 1, 1)()
+
+	w := serve(uploadRequest(t, "solid=true&units=6&unitSize=5&crop=fit&format=png", testUpload(t)))
+	res := decodeMosaic(t, w)
+	if m := waitDone(t, res.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+
+	res = decodeMosaic(t, serve(httptest.NewRequest("GET", res.URL, nil)))
+	if res.Progress != 100 {
+		t.Errorf("progress got %d, want 100", res.Progress)
+	}
+
+	w = serve(httptest.NewRequest("GET", res.ImgURL, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("image status got %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Header().Get("Content-Type"), "image/png"; got != want {
+		t.Errorf("Content-Type got %s, want %s", got, want)
+	}
+	m, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6 units across the 60px side, 4 down the 40px side.
+	if got, want := m.Bounds().Size(), image.Pt(30, 20); got != want {
+		t.Errorf("size got %v, want %v", got, want)
+	}
+
+	// A rendition is made once and kept until the mosaic is deleted.
+	w = serve(httptest.NewRequest("GET", res.ImgURL+"&width=15&region=0,0,30,10", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rendition status got %d: %s", w.Code, w.Body)
+	}
+	if m, err = png.Decode(w.Body); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Bounds().Size(), image.Pt(15, 5); got != want {
+		t.Errorf("rendition size got %v, want %v", got, want)
+	}
+	if m, _ := mosaics.Get(mosaicID(res.ID)); len(m.Renditions) != 1 {
+		t.Errorf("got renditions %v, want 1", m.Renditions)
+	}
+	w = serve(httptest.NewRequest("GET", res.ImgURL+"&region=20,0,30,10", nil))
+	expectErr(t, "region", w, http.StatusBadRequest, CodeInvalidParam)
+
+	w = serve(httptest.NewRequest("GET", "/mosaics/events?id="+res.ID, nil))
+	if got, want := w.Header().Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("events Content-Type got %s, want %s", got, want)
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "event: mosaic\ndata: {") || !strings.Contains(body, `"status":"created"`) {
+		t.Errorf("events got %q", body)
+	}
+}
+
+func TestResumeMosaics(t *testing.T) {
+	// With no workers the mosaics are still unfinished at the restart.
+	defer setupService(t, 0, 1)()
+	queued := decodeMosaic(t, serve(uploadRequest(t, "solid=true&units=6&unitSize=5", testUpload(t))))
+	lost, err := mosaics.Create("cat", mosaicParams{Units: 6, UnitSize: 5, Solid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart, reloading the mosaics from disk.
+	mosaics, err = newMosaicInventory(mosaics.cache, mosaics.dir, mosaics.filesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue = newJobQueue(1, 1, runMosaic)
+	resumeMosaics()
+
+	if m := waitDone(t, queued.ID); m.Status != MosaicStatusCreated {
+		t.Errorf("queued got status %s, want created: %s", m.Status, m.Reason)
+	}
+	if w := serve(httptest.NewRequest("GET", queued.ImgURL, nil)); w.Code != http.StatusOK {
+		t.Errorf("queued image status got %d: %s", w.Code, w.Body)
+	}
+	if m := waitDone(t, string(lost.ID)); m.Status != MosaicStatusFailed {
+		t.Errorf("missing upload got status %s, want failed", m.Status)
+	}
+}
+
+func TestRenderMosaic_caching(t *testing.T) {
+	defer setupService(t, 1, 1)()
+	res := decodeMosaic(t, serve(uploadRequest(t, "solid=true&units=6&unitSize=5", testUpload(t))))
+	if m := waitDone(t, res.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+
+	for _, imgURL := range []string{res.ImgURL, res.ImgURL + "&size=thumbnail&fit=cover"} {
+		w := serve(httptest.NewRequest("GET", imgURL, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status got %d: %s", imgURL, w.Code, w.Body)
+		}
+		body := w.Body.Bytes()
+		etag := w.Header().Get("ETag")
+		lastModified := w.Header().Get("Last-Modified")
+		if etag == "" || lastModified == "" {
+			t.Errorf("%s want ETag and Last-Modified, got %v", imgURL, w.Header())
+		}
+		if got, want := w.Header().Get("Content-Length"), strconv.Itoa(len(body)); got != want {
+			t.Errorf("%s Content-Length got %s, want %s", imgURL, got, want)
+		}
+		if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, "public, max-age=") {
+			t.Errorf("%s Cache-Control got %q", imgURL, got)
+		}
+
+		// A client with a copy doesn't get it again.
+		for name, value := range map[string]string{
+			"If-None-Match":     etag,
+			"If-Modified-Since": lastModified,
+		} {
+			r := httptest.NewRequest("GET", imgURL, nil)
+			r.Header.Set(name, value)
+			if w := serve(r); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+				t.Errorf("%s %s got %d with %d bytes, want 304", imgURL, name, w.Code, w.Body.Len())
+			}
+		}
+
+		// Part of the image can be fetched.
+		r := httptest.NewRequest("GET", imgURL, nil)
+		r.Header.Set("Range", "bytes=2-9")
+		w = serve(r)
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), body[2:10]) {
+			t.Errorf("%s range got %d %q, want 206 %q", imgURL, w.Code, w.Body.Bytes(), body[2:10])
+		}
+
+		// The same bytes are served again.
+		if w := serve(httptest.NewRequest("GET", imgURL, nil)); !bytes.Equal(w.Body.Bytes(), body) {
+			t.Errorf("%s body changed", imgURL)
+		}
+	}
+
+	// A mosaic that's about to expire isn't cached for long.
+	defer func(d time.Duration) { MosaicRetention = d }(MosaicRetention)
+	MosaicRetention = time.Minute
+	w := serve(httptest.NewRequest("GET", res.ImgURL, nil))
+	got := w.Header().Get("Cache-Control")
+	if secs, err := strconv.Atoi(strings.TrimPrefix(got, "public, max-age=")); err != nil || secs < 1 || secs > 60 {
+		t.Errorf("Cache-Control got %q, want at most a minute", got)
+	}
+}
+
+func TestRenderMosaic_busy(t *testing.T) {
+	defer setupService(t, 1, 1)()
+	defer func(n int) { MaxRenders = n }(MaxRenders)
+	MaxRenders = 1
+	res := decodeMosaic(t, serve(uploadRequest(t, "solid=true&units=6&unitSize=5", testUpload(t))))
+	if m := waitDone(t, res.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+	thumb := res.ImgURL + "&size=thumbnail"
+	if w := serve(httptest.NewRequest("GET", thumb, nil)); w.Code != http.StatusOK {
+		t.Fatalf("thumbnail status got %d: %s", w.Code, w.Body)
+	}
+
+	// While another is being rendered, only stored images are served.
+	if !startRender() {
+		t.Fatal("startRender got false")
+	}
+	w := serve(httptest.NewRequest("GET", res.ImgURL+"&width=10", nil))
+	expectErr(t, "busy", w, http.StatusServiceUnavailable, CodeBusy)
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Errorf("want a Retry-After header")
+	}
+	for _, imgURL := range []string{res.ImgURL, thumb} {
+		if w := serve(httptest.NewRequest("GET", imgURL, nil)); w.Code != http.StatusOK {
+			t.Errorf("%s status got %d: %s", imgURL, w.Code, w.Body)
+		}
+	}
+	finishRender()
+	if w := serve(httptest.NewRequest("GET", res.ImgURL+"&width=10", nil)); w.Code != http.StatusOK {
+		t.Errorf("rendition status got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestExpireMosaics(t *testing.T) {
+	defer setupService(t, 1, 2)()
+	defer func(d time.Duration) { MosaicRetention = d }(MosaicRetention)
+	MosaicRetention = 500 * time.Millisecond
+
+	// Only done mosaics expire.
+	old := decodeMosaic(t, serve(uploadRequest(t, "solid=true&units=6&unitSize=5", testUpload(t))))
+	if m := waitDone(t, old.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+	time.Sleep(MosaicRetention)
+	recent := decodeMosaic(t, serve(uploadRequest(t, "solid=true&units=6&unitSize=5", testUpload(t))))
+	waitDone(t, recent.ID)
+
+	deleteExpiredMosaics()
+	w := serve(httptest.NewRequest("GET", old.URL, nil))
+	expectErr(t, "expired", w, http.StatusNotFound, CodeNotFound)
+	if _, err := mosaics.OpenImage(mosaicID(old.ID), rendition{}.File(FormatJPEG)); !os.IsNotExist(err) {
+		t.Errorf("expired image should be deleted, got %v", err)
+	}
+	if w := serve(httptest.NewRequest("GET", recent.URL, nil)); w.Code != http.StatusOK {
+		t.Errorf("recent mosaic got %d, want 200", w.Code)
+	}
+}
+
+func TestCreateMosaic_srcURL(t *testing.T) {
+	defer setupService(t, 1, 1)()
+	img := testUpload(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	}))
+	defer origin.Close()
+	defer func(h []string) { SourceHosts = h }(SourceHosts)
+
+	// Not allowed until the origin is.
+	src := url.QueryEscape(origin.URL + "/in.png")
+	w := serve(httptest.NewRequest("POST", "/mosaics?solid=true&src_url="+src, nil))
+	expectErr(t, "not allowed", w, http.StatusBadRequest, CodeInvalidSource)
+
+	SourceHosts = []string{"127.0.0.1"}
+	w = serve(uploadRequest(t, "solid=true&src_url="+src, img))
+	expectErr(t, "both", w, http.StatusBadRequest, CodeInvalidParam)
+
+	w = serve(httptest.NewRequest("POST", "/mosaics?solid=true&units=6&unitSize=5&crop=fit&src_url="+src, nil))
+	res := decodeMosaic(t, w)
+	if got, want := res.Params.SourceURL, origin.URL+"/in.png"; got != want {
+		t.Errorf("src_url got %s, want %s", got, want)
+	}
+	if m := waitDone(t, res.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+}
+
+func TestCreateMosaic_tag(t *testing.T) {
+	defer setupService(t, 1, 1)()
+
+	w := serve(uploadRequest(t, "tag=balloon&units=4&unitSize=10", testUpload(t)))
+	res := decodeMosaic(t, w)
+	m := waitDone(t, res.ID)
+	if m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+	res = decodeMosaic(t, serve(httptest.NewRequest("GET", res.URL, nil)))
+	if len(res.Credits) == 0 {
+		t.Errorf("want credits for the thumbs used")
+	}
+}
+
+func TestCreateMosaic_namedInventory(t *testing.T) {
+	defer setupService(t, 1, 1)()
+
+	res := decodeMosaic(t, serve(uploadRequest(t, "tag=popular&units=6&unitSize=5", testUpload(t))))
+	if m := waitDone(t, res.ID); m.Status != MosaicStatusCreated {
+		t.Fatalf("got status %s, want created: %s", m.Status, m.Reason)
+	}
+	if fakeAPI.Requests("/v1/media/popular") == 0 {
+		t.Errorf("want requests for popular media")
+	}
+	if n := fakeAPI.Requests("/v1/tags/"); n != 0 {
+		t.Errorf("got %d requests for tagged media, want none", n)
+	}
+}
+
+func TestCreateMosaic_failed(t *testing.T) {
+	defer setupService(t, 1, 1)()
+
+	// The fake server has no images for this tag.
+	w := serve(uploadRequest(t, "tag=nothing", testUpload(t)))
+	res := decodeMosaic(t, w)
+	m := waitDone(t, res.ID)
+	if m.Status != MosaicStatusFailed {
+		t.Fatalf("got status %s, want failed", m.Status)
+	}
+
+	res = decodeMosaic(t, serve(httptest.NewRequest("GET", res.URL, nil)))
+	if got, want := res.Reason, "no images are available"; got != want {
+		t.Errorf("reason got %q, want %q", got, want)
+	}
+	w = serve(httptest.NewRequest("GET", res.ImgURL, nil))
+	expectErr(t, "image", w, http.StatusConflict, CodeNotReady)
+}
+
+func TestCreateMosaic_callback(t *testing.T) {
+	defer setupService(t, 1, 1)()
+	defer func(h []string, s string, d time.Duration) {
+		CallbackHosts, CallbackSecret, CallbackRetryDelay = h, s, d
+	}(CallbackHosts, CallbackSecret, CallbackRetryDelay)
+	CallbackSecret = "shh"
+	CallbackRetryDelay = time.Millisecond
+
+	// The receiver fails once, then accepts the callback.
+	var calls int32
+	received := make(chan *http.Request, 2)
+	bodies := make(chan []byte, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	// Not allowed until the receiver is.
+	callback := url.QueryEscape(receiver.URL + "/done")
+	w := serve(uploadRequest(t, "solid=true&callback_url="+callback, testUpload(t)))
+	expectErr(t, "not allowed", w, http.StatusBadRequest, CodeInvalidParam)
+
+	CallbackHosts = []string{"127.0.0.1"}
+	w = serve(uploadRequest(t, "solid=true&units=6&unitSize=5&callback_url="+callback, testUpload(t)))
+	res := decodeMosaic(t, w)
+	if got, want := res.Params.CallbackURL, receiver.URL+"/done"; got != want {
+		t.Errorf("callback_url got %s, want %s", got, want)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			body := <-bodies
+			if got, want := r.Header.Get(SignatureHeader), "sha256="+signCallback("shh", body); got != want {
+				t.Errorf("signature got %s, want %s", got, want)
+			}
+			var got mosaicRes
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != res.ID || got.Status != MosaicStatusCreated {
+				t.Errorf("callback got %s %s, want %s created", got.ID, got.Status, res.ID)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for callback %d", i+1)
+		}
+	}
+	callbacks.Wait()
+
+	res = decodeMosaic(t, serve(httptest.NewRequest("GET", res.URL, nil)))
+	if len(res.Deliveries) != 2 {
+		t.Fatalf("got %d deliveries, want 2", len(res.Deliveries))
+	}
+	if d := res.Deliveries[0]; d.OK || d.Status != http.StatusInternalServerError {
+		t.Errorf("first delivery got %+v, want status 500", d)
+	}
+	if d := res.Deliveries[1]; !d.OK || d.Attempt != 2 {
+		t.Errorf("second delivery got %+v, want attempt 2 ok", d)
+	}
+}
+
+// failingCache is an ImageCache that can't store anything.
+type failingCache struct {
+	mosaic.ImageCache
+}
+
+func (failingCache) Put(mosaic.ImageCacheKey, image.Image) error {
+	return errors.New("disk full")
+}
+
+func TestCreateMosaic_callbackAborted(t *testing.T) {
+	defer setupService(t, 1, 1)()
+	defer func(h []string) { CallbackHosts = h }(CallbackHosts)
+	CallbackHosts = []string{"127.0.0.1"}
+	received := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- body
+	}))
+	defer receiver.Close()
+
+	// The upload can't be stored, so the mosaic fails before it's queued.
+	mosaics.cache = failingCache{mosaics.cache}
+	callback := url.QueryEscape(receiver.URL + "/done")
+	w := serve(uploadRequest(t, "solid=true&callback_url="+callback, testUpload(t)))
+	expectErr(t, "aborted", w, http.StatusInternalServerError, CodeInternal)
+	select {
+	case body := <-received:
+		var got mosaicRes
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != MosaicStatusFailed {
+			t.Errorf("callback got status %s, want failed", got.Status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for callback")
+	}
+	callbacks.Wait()
+}
+
+func TestGetMosaic_invalid(t *testing.T) {
+	defer setupService(t, 0, 1)()
+	for _, path := range []string{"/mosaics", "/mosaics/img", "/mosaics/events", "/mosaics/cancel"} {
+		method := "GET"
+		if path == "/mosaics/cancel" {
+			method = "POST"
+		}
+		if path != "/mosaics" {
+			w := serve(httptest.NewRequest(method, path, nil))
+			expectErr(t, path+" no id", w, http.StatusBadRequest, CodeInvalidParam)
+		}
+		w := serve(httptest.NewRequest(method, path+"?id=nope", nil))
+		expectErr(t, path+" unknown id", w, http.StatusNotFound, CodeNotFound)
+	}
+	w := serve(httptest.NewRequest("DELETE", "/mosaics?id=nope", nil))
+	expectErr(t, "delete unknown id", w, http.StatusNotFound, CodeNotFound)
+}
+
+func TestMethods(t *testing.T) {
+	defer setupService(t, 0, 1)()
+	for _, test := range []struct {
+		method, path, allow string
+	}{
+		{"PUT", "/mosaics", "DELETE, GET, POST"},
+		{"POST", "/mosaics/img", "GET"},
+		{"GET", "/mosaics/cancel", "POST"},
+		{"DELETE", "/inventory", "GET, POST"},
+	} {
+		name := test.method + " " + test.path
+		w := serve(httptest.NewRequest(test.method, test.path, nil))
+		expectErr(t, name, w, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+		if got := w.Header().Get("Allow"); got != test.allow {
+			t.Errorf("%s: Allow got %q, want %q", name, got, test.allow)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+	defer setupService(t, 0, 1)()
+
+	w := serve(httptest.NewRequest("POST", "/inventory", nil))
+	expectErr(t, "no params", w, http.StatusBadRequest, CodeInvalidParam)
+	w = serve(httptest.NewRequest("POST", "/inventory?lat=north&lng=1", nil))
+	expectErr(t, "bad lat", w, http.StatusBadRequest, CodeInvalidParam)
+	w = serve(httptest.NewRequest("POST", "/inventory?tag=..%2Fmosaics", nil))
+	expectErr(t, "bad tag", w, http.StatusBadRequest, CodeInvalidParam)
+
+	w = serve(httptest.NewRequest("POST", "/inventory?tag=cat", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status got %d: %s", w.Code, w.Body)
+	}
+	done, err := thumbs.AddTag("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	var res inventoryRes
+	w = serve(httptest.NewRequest("GET", "/inventory", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Images) != 1 || res.Images[0].Tag != "cat" || res.Images[0].Count == 0 {
+		t.Errorf("got inventory %+v", res.Images)
+	}
+}
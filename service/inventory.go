@@ -1,10 +1,21 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
 	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
@@ -13,139 +24,706 @@ import (
 const (
 	// MosaicStatusNew is a mosaic that has been stored but not worked on.
 	MosaicStatusNew = "new"
+	// MosaicStatusQueued is a mosaic that is waiting to be generated.
+	MosaicStatusQueued = "queued"
 	// MosaicStatusWorking is a mosaic that is being generated.
 	MosaicStatusWorking = "working"
 	// MosaicStatusFailed is a mosaic that failed to be generated.
 	MosaicStatusFailed = "failed"
 	// MosaicStatusCreated is a mosaic that was generated.
 	MosaicStatusCreated = "created"
+	// MosaicStatusCancelled is a mosaic that was stopped before it was
+	// generated.
+	MosaicStatusCancelled = "cancelled"
 )
 
 var (
 	// ImagesPerTag is how many images to download when populating a tag.
-	ImagesPerTag    = 1000
-	mosaicIDCounter = 0
+	ImagesPerTag = 1000
+	// FetchTimeout is how long to spend fetching images for a tag.
+	FetchTimeout = 10 * time.Minute
+	// FetchWorkers is how many images to download at once per tag.
+	FetchWorkers = mosaic.DefaultFetchWorkers
+	// DedupeHash, if set, rejects thumbs within DedupeDistance of another
+	// thumb for the tag.
+	DedupeHash     mosaic.HashFunc
+	DedupeDistance = 4
+	// Filters skip thumbs that shouldn't be used in mosaics.
+	Filters []mosaic.FilterFunc
+	// TagQuota limits the thumbs stored for each tag.
+	TagQuota mosaic.Quota
+	// TotalQuota limits the thumbs stored for all tags together.
+	TotalQuota mosaic.Quota
+	// Eviction decides which thumbs are removed to meet the quotas.
+	Eviction = mosaic.EvictOldest
 )
 
-// Inventory of mosaics that have been created.
+// Inventory of mosaics that have been created. Records are stored as JSON
+// files in dir so that they survive restarts, and images are stored encoded
+// in a dir for each mosaic in filesDir so that they can be served as is.
 type mosaicInventory struct {
-	cache   mosaic.ImageCache
-	mosaics []*mosaicRecord
+	cache    mosaic.ImageCache
+	dir      string
+	filesDir string
+
+	mu       sync.Mutex
+	mosaics  []*mosaicRecord
+	watchers map[mosaicID]map[chan mosaicRecord]bool
 }
 
 type mosaicID string
 
 type mosaicRecord struct {
-	ID     mosaicID
-	Tag    string
-	Status string
+	ID      mosaicID     `json:"id"`
+	Tag     string       `json:"tag"`
+	Status  string       `json:"status"`
+	Params  mosaicParams `json:"params"`
+	Created time.Time    `json:"created"`
+	Updated time.Time    `json:"updated"`
+	// Reason explains why the mosaic failed.
+	Reason string `json:"reason,omitempty"`
+	// Stage is the step of generating the mosaic that's being worked on.
+	Stage string `json:"stage,omitempty"`
+	// Progress is how much of the mosaic is done, as a percent.
+	Progress int `json:"progress"`
+	// Credits attribute the thumbs used in the mosaic.
+	Credits []mosaic.Credit `json:"credits,omitempty"`
+	// Deliveries are the attempts to post the mosaic to its callback_url.
+	Deliveries []callbackDelivery `json:"deliveries,omitempty"`
+	// Renditions are the files of the resized or cropped images that are
+	// stored.
+	Renditions []string `json:"renditions,omitempty"`
+}
+
+// Done returns true if the mosaic won't change any more.
+func (m *mosaicRecord) Done() bool {
+	switch m.Status {
+	case MosaicStatusCreated, MosaicStatusFailed, MosaicStatusCancelled:
+		return true
+	}
+	return false
 }
 
-func (i *mosaicInventory) Create(tag string) (*mosaicRecord, error) {
-	mosaicIDCounter++
-	id := mosaicID(fmt.Sprintf("%d", mosaicIDCounter))
+// newMosaicInventory loads the records stored in dir.
+func newMosaicInventory(cache mosaic.ImageCache, dir, filesDir string) (*mosaicInventory, error) {
+	for _, d := range []string{dir, filesDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	i := &mosaicInventory{
+		cache:    cache,
+		dir:      dir,
+		filesDir: filesDir,
+		watchers: make(map[mosaicID]map[chan mosaicRecord]bool),
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		js, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var m mosaicRecord
+		if err := json.Unmarshal(js, &m); err != nil {
+			log.Printf("Skipping unreadable mosaic record %s: %s\n", p, err)
+			continue
+		}
+		i.mosaics = append(i.mosaics, &m)
+	}
+	sort.Slice(i.mosaics, func(a, b int) bool {
+		if !i.mosaics[a].Created.Equal(i.mosaics[b].Created) {
+			return i.mosaics[a].Created.Before(i.mosaics[b].Created)
+		}
+		return i.mosaics[a].ID < i.mosaics[b].ID
+	})
+	return i, nil
+}
+
+// newMosaicID returns a unique id that sorts by creation time, like a ULID:
+// 48 bits of milliseconds followed by 80 random bits, in hex.
+func newMosaicID(now time.Time) (mosaicID, error) {
+	b := make([]byte, 16)
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for n := 0; n < 6; n++ {
+		b[n] = byte(ms >> uint(8*(5-n)))
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	return mosaicID(hex.EncodeToString(b)), nil
+}
+
+func (i *mosaicInventory) Create(tag string, params mosaicParams) (*mosaicRecord, error) {
+	now := time.Now()
+	id, err := newMosaicID(now)
+	if err != nil {
+		return nil, err
+	}
 	d := &mosaicRecord{
-		ID:     id,
-		Tag:    tag,
-		Status: MosaicStatusNew,
+		ID:      id,
+		Tag:     tag,
+		Status:  MosaicStatusNew,
+		Params:  params,
+		Created: now,
+		Updated: now,
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.save(d); err != nil {
+		return nil, err
 	}
 	i.mosaics = append(i.mosaics, d)
-	return d, nil
+	c := *d
+	return &c, nil
 }
 
+// Get returns a copy of the record, or nil if there's no such mosaic.
 func (i *mosaicInventory) Get(id mosaicID) (*mosaicRecord, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	for _, m := range i.mosaics {
 		if m.ID == id {
-			return m, nil
+			c := *m
+			return &c, nil
 		}
 	}
 	return nil, nil
 }
 
+// SetStatus changes the status of the mosaic. A cancelled mosaic stays
+// cancelled.
 func (i *mosaicInventory) SetStatus(id mosaicID, status string) error {
+	return i.update(id, func(d *mosaicRecord) {
+		if d.Status == MosaicStatusCancelled {
+			return
+		}
+		d.Status = status
+		if status == MosaicStatusCreated {
+			d.Stage = ""
+			d.Progress = 100
+		}
+	})
+}
+
+// SetProgress updates how much of the mosaic is done. The record is only
+// stored when the stage changes, since progress is reported often.
+func (i *mosaicInventory) SetProgress(id mosaicID, stage string, percent int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	for _, d := range i.mosaics {
 		if d.ID == id {
-			d.Status = status
-			break
+			if d.Stage == stage && d.Progress == percent {
+				return nil
+			}
+			c := *d
+			c.Stage = stage
+			c.Progress = percent
+			c.Updated = time.Now()
+			if d.Stage != stage {
+				if err := i.save(&c); err != nil {
+					return err
+				}
+			}
+			*d = c
+			i.notify(c)
+			return nil
 		}
 	}
-	return nil
+	return fmt.Errorf("no mosaic %s", id)
 }
 
-func (i *mosaicInventory) StoreImage(id mosaicID, m image.Image) error {
-	key := i.cache.Key(string(id))
-	if err := i.cache.Put(key, m); err != nil {
+// Watch returns a channel that receives the record each time it changes.
+// Slow readers only see the latest change. Call stop when done.
+func (i *mosaicInventory) Watch(id mosaicID) (changes <-chan mosaicRecord, stop func()) {
+	ch := make(chan mosaicRecord, 1)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.watchers[id] == nil {
+		i.watchers[id] = make(map[chan mosaicRecord]bool)
+	}
+	i.watchers[id][ch] = true
+	return ch, func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		delete(i.watchers[id], ch)
+		if len(i.watchers[id]) == 0 {
+			delete(i.watchers, id)
+		}
+	}
+}
+
+// notify sends a changed record to its watchers, replacing any change they
+// haven't read yet. The caller must hold mu.
+func (i *mosaicInventory) notify(d mosaicRecord) {
+	for ch := range i.watchers[d.ID] {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- d:
+		default:
+		}
+	}
+}
+
+// Fail marks the mosaic failed, with the reason, unless it was cancelled.
+func (i *mosaicInventory) Fail(id mosaicID, reason string) error {
+	return i.update(id, func(d *mosaicRecord) {
+		if d.Status == MosaicStatusCancelled {
+			return
+		}
+		d.Status = MosaicStatusFailed
+		d.Reason = reason
+	})
+}
+
+// Cancel marks the mosaic cancelled, unless it's already done.
+func (i *mosaicInventory) Cancel(id mosaicID) error {
+	return i.update(id, func(d *mosaicRecord) {
+		if !d.Done() {
+			d.Status = MosaicStatusCancelled
+			d.Stage = ""
+		}
+	})
+}
+
+func (i *mosaicInventory) SetCredits(id mosaicID, credits []mosaic.Credit) error {
+	return i.update(id, func(d *mosaicRecord) {
+		d.Credits = credits
+	})
+}
+
+// AddDelivery records an attempt to deliver the mosaic's callback.
+func (i *mosaicInventory) AddDelivery(id mosaicID, d callbackDelivery) error {
+	return i.update(id, func(m *mosaicRecord) {
+		m.Deliveries = append(m.Deliveries[:len(m.Deliveries):len(m.Deliveries)], d)
+	})
+}
+
+// update changes a record and stores it.
+func (i *mosaicInventory) update(id mosaicID, fn func(*mosaicRecord)) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, d := range i.mosaics {
+		if d.ID == id {
+			c := *d
+			fn(&c)
+			c.Updated = time.Now()
+			if err := i.save(&c); err != nil {
+				return err
+			}
+			*d = c
+			i.notify(c)
+			return nil
+		}
+	}
+	return fmt.Errorf("no mosaic %s", id)
+}
+
+// save writes a record.
+func (i *mosaicInventory) save(d *mosaicRecord) error {
+	js, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFile(i.dir, string(d.ID)+".json", js)
+}
+
+// writeFile writes data to a temp file and renames it into place, so that a
+// crash never leaves a partial file.
+func writeFile(dir, name string, data []byte) error {
+	fo, err := ioutil.TempFile(dir, fmt.Sprintf(".%s.*.tmp", name))
+	if err != nil {
+		return err
+	}
+	tmp := fo.Name()
+	if _, err := fo.Write(data); err != nil {
+		fo.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fo.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
 		return err
 	}
 	return nil
 }
 
-func (i *mosaicInventory) GetImage(id mosaicID) (image.Image, error) {
-	key := i.cache.Key(string(id))
-	return i.cache.Get(key)
+// StoreImage keeps an encoded image of a mosaic as the named file.
+// It's an error if the mosaic has been deleted, so that a job that's still
+// running can't leave behind an image that nothing refers to.
+func (i *mosaicInventory) StoreImage(id mosaicID, name string, data []byte) error {
+	// Hold the lock so that Delete can't remove the record until the image
+	// is written.
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	found := false
+	for _, d := range i.mosaics {
+		if d.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("no mosaic %s", id)
+	}
+	dir := filepath.Join(i.filesDir, string(id))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFile(dir, name, data)
+}
+
+// OpenImage opens an encoded image of a mosaic. The error satisfies
+// os.IsNotExist if it isn't stored.
+func (i *mosaicInventory) OpenImage(id mosaicID, name string) (*os.File, error) {
+	return os.Open(filepath.Join(i.filesDir, string(id), name))
+}
+
+// GetCachedImage returns a mosaic image from the cache, where mosaics were
+// stored before their encoded images were.
+func (i *mosaicInventory) GetCachedImage(id mosaicID) (image.Image, error) {
+	return i.cache.Get(i.cache.Key(string(id)))
+}
+
+// StoreRendition keeps an encoded, resized or cropped image of a mosaic as
+// the named file. It returns false if the mosaic has MaxRenditions already.
+func (i *mosaicInventory) StoreRendition(id mosaicID, name string, data []byte) (bool, error) {
+	var full bool
+	err := i.update(id, func(d *mosaicRecord) {
+		for _, n := range d.Renditions {
+			if n == name {
+				return
+			}
+		}
+		if len(d.Renditions) >= MaxRenditions {
+			full = true
+			return
+		}
+		d.Renditions = append(d.Renditions[:len(d.Renditions):len(d.Renditions)], name)
+	})
+	if err != nil || full {
+		return false, err
+	}
+	return true, i.StoreImage(id, name, data)
+}
+
+// StoreUpload keeps the image a mosaic is made from until it's generated, so
+// that queued mosaics can be resumed after a restart.
+func (i *mosaicInventory) StoreUpload(id mosaicID, m image.Image) error {
+	return i.cache.Put(i.uploadKey(id), m)
+}
+
+func (i *mosaicInventory) GetUpload(id mosaicID) (image.Image, error) {
+	return i.cache.Get(i.uploadKey(id))
+}
+
+func (i *mosaicInventory) DeleteUpload(id mosaicID) error {
+	return i.cache.Delete(i.uploadKey(id))
+}
+
+func (i *mosaicInventory) uploadKey(id mosaicID) mosaic.ImageCacheKey {
+	return i.cache.Key(string(id) + "/upload")
 }
 
 func (i *mosaicInventory) Size() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	return len(i.mosaics)
 }
 
+// Unfinished returns copies of the records that aren't done, oldest first.
+func (i *mosaicInventory) Unfinished() []*mosaicRecord {
+	var list []*mosaicRecord
+	for _, m := range i.List() {
+		if !m.Done() {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// Expired returns copies of the records that are done and were created
+// before t.
+func (i *mosaicInventory) Expired(t time.Time) []*mosaicRecord {
+	var list []*mosaicRecord
+	for _, m := range i.List() {
+		if m.Done() && m.Created.Before(t) {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// Delete removes the mosaic's record, images and upload. It is not an error
+// to delete a mosaic that doesn't exist.
+func (i *mosaicInventory) Delete(id mosaicID) error {
+	// Remove the record first, so that StoreImage refuses images from a
+	// job that's still running.
+	i.mu.Lock()
+	for n, d := range i.mosaics {
+		if d.ID == id {
+			i.mosaics = append(i.mosaics[:n], i.mosaics[n+1:]...)
+			break
+		}
+	}
+	err := os.Remove(filepath.Join(i.dir, string(id)+".json"))
+	i.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := i.cache.Delete(i.cache.Key(string(id))); err != nil {
+		return err
+	}
+	if err := i.DeleteUpload(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(i.filesDir, string(id)))
+}
+
+// List returns copies of the records, oldest first.
 func (i *mosaicInventory) List() []*mosaicRecord {
-	return i.mosaics
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	list := make([]*mosaicRecord, len(i.mosaics))
+	for n, m := range i.mosaics {
+		c := *m
+		list[n] = &c
+	}
+	return list
 }
 
-type tagCacheFunc func(string) mosaic.ImageCache
+type tagCacheFunc func(string) (mosaic.ImageCache, error)
 
 // thumbInventory tracks the thumbnails that have been acquired.
 type thumbInventory struct {
 	tagCacheFunc
 	api instagram.Client
+	// tags lists the tags that have stored thumbs, including those fetched
+	// before the server started. If nil, only the added tags are known.
+	tags func() ([]string, error)
 
 	mu     sync.Mutex
 	images map[string]*mosaic.ImageInventory
 	states map[string]chan bool
 }
 
-func (i *thumbInventory) AddTag(tag string) chan bool {
+// PopularTag is the inventory name for Instagram's popular images.
+const PopularTag = "popular"
+
+// LocationTag is the inventory name for images posted near a location. It
+// includes the distance and the window of time searched, if they're given,
+// as "-from" and "-to" unix timestamps.
+func LocationTag(q instagram.LocationQuery) string {
+	tag := fmt.Sprintf("near-%s,%s", q.Lat, q.Lng)
+	if q.Distance > 0 {
+		tag += fmt.Sprintf("-%dm", q.Distance)
+	}
+	if !q.MinTime.IsZero() {
+		tag += fmt.Sprintf("-from%d", q.MinTime.Unix())
+	}
+	if !q.MaxTime.IsZero() {
+		tag += fmt.Sprintf("-to%d", q.MaxTime.Unix())
+	}
+	return tag
+}
+
+// locationTagRE matches the names made by LocationTag. The lng is as short as
+// possible, so that the suffixes aren't taken as part of it.
+var locationTagRE = regexp.MustCompile(`^near-([^,]+),(.+?)(?:-(\d+)m)?(?:-from(-?\d+))?(?:-to(-?\d+))?$`)
+
+// parseLocationTag reads the query that a LocationTag name was made from.
+func parseLocationTag(tag string) (instagram.LocationQuery, bool) {
+	var q instagram.LocationQuery
+	m := locationTagRE.FindStringSubmatch(tag)
+	if m == nil {
+		return q, false
+	}
+	q.Lat, q.Lng = m[1], m[2]
+	for _, s := range []string{q.Lat, q.Lng} {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return q, false
+		}
+	}
+	if m[3] != "" {
+		q.Distance, _ = strconv.Atoi(m[3])
+	}
+	if m[4] != "" {
+		secs, _ := strconv.ParseInt(m[4], 10, 64)
+		q.MinTime = time.Unix(secs, 0)
+	}
+	if m[5] != "" {
+		secs, _ := strconv.ParseInt(m[5], 10, 64)
+		q.MaxTime = time.Unix(secs, 0)
+	}
+	// Only a name that LocationTag would make is the same inventory.
+	return q, LocationTag(q) == tag
+}
+
+// AddNamed begins fetching images into the named inventory, from the popular
+// images if it's PopularTag, near a location if it's a LocationTag, or else
+// by tag.
+func (i *thumbInventory) AddNamed(name string) (chan bool, error) {
+	if name == PopularTag {
+		return i.AddPopular()
+	}
+	if q, ok := parseLocationTag(name); ok {
+		return i.AddLocation(q)
+	}
+	return i.AddTag(name)
+}
+
+// AddTag begins fetching images with a tag. The returned channel is closed
+// when the fetch is done. It's an error if the tag's cache can't be created.
+func (i *thumbInventory) AddTag(tag string) (chan bool, error) {
+	return i.add(tag, instagram.NewTagFetcher(i.api, tag))
+}
+
+// AddPopular begins fetching popular images into the PopularTag inventory.
+func (i *thumbInventory) AddPopular() (chan bool, error) {
+	return i.add(PopularTag, instagram.NewPopularFetcher(i.api))
+}
+
+// AddLocation begins fetching images posted near a location into the
+// LocationTag inventory.
+func (i *thumbInventory) AddLocation(q instagram.LocationQuery) (chan bool, error) {
+	return i.add(LocationTag(q), instagram.NewLocationFetcher(i.api, q))
+}
+
+// add begins fetching images from f into the named inventory, unless it's
+// already been started.
+func (i *thumbInventory) add(tag string, f instagram.Fetcher) (chan bool, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
 	// Initialize the inventory.
 	if _, ok := i.images[tag]; !ok {
-		cache := i.tagCacheFunc(tag)
+		cache, err := i.tagCacheFunc(tag)
+		if err != nil {
+			return nil, err
+		}
 		i.images[tag] = mosaic.NewImageInventory(cache)
-
+		i.images[tag].SetFetchWorkers(FetchWorkers)
+		if DedupeHash != nil {
+			i.images[tag].RejectDuplicates(DedupeHash, DedupeDistance)
+		}
+		i.images[tag].Filter(Filters...)
 	}
 	inv := i.images[tag]
 
 	// Initialize the state.
 	if ch, ok := i.states[tag]; ok {
 		log.Printf("AddTag(%s) already has it\n", tag)
-		return ch
+		return ch, nil
 	}
-	i.states[tag] = make(chan bool)
+	ch := make(chan bool)
+	i.states[tag] = ch
 
 	log.Printf("AddTag(%s) beginning fetch\n", tag)
 	go func() {
-		fetcher := instagram.NewTagFetcher(i.api, tag)
-		if err := inv.Fetch(fetcher, ImagesPerTag); err != nil {
-			log.Printf("Failed to fetch tag %s: %s", tag, err)
+		ctx, cancel := context.WithTimeout(context.Background(), FetchTimeout)
+		defer cancel()
+		if err := inv.Fetch(ctx, instagram.NewSource(f), ImagesPerTag); err != nil {
+			if instagram.IsRateLimited(err) {
+				log.Printf("Rate limited fetching tag %s, stored %d images", tag, inv.Size())
+			} else {
+				log.Printf("Failed to fetch tag %s: %s", tag, err)
+			}
+		}
+		if err := i.Prune(); err != nil {
+			log.Printf("Failed to prune thumbs: %s", err)
 		}
-		close(i.states[tag])
+		close(ch)
 	}()
 
-	return i.states[tag]
+	return ch, nil
 }
 
-func (i *thumbInventory) PopulatePalette(tag string, p *mosaic.ImagePalette) error {
-	inventory, ok := i.images[tag]
+// Prune removes thumbs to stay within TagQuota and TotalQuota. Every stored
+// tag counts towards TotalQuota, not only those added since the server
+// started.
+func (i *thumbInventory) Prune() error {
+	if TagQuota == (mosaic.Quota{}) && TotalQuota == (mosaic.Quota{}) {
+		return nil
+	}
+	var stored []string
+	if i.tags != nil {
+		var err error
+		if stored, err = i.tags(); err != nil {
+			return err
+		}
+	}
+	i.mu.Lock()
+	invs := make(map[string]*mosaic.ImageInventory, len(i.images))
+	for tag, inv := range i.images {
+		invs[tag] = inv
+	}
+	i.mu.Unlock()
+	// Tags that haven't been added are only opened to prune them.
+	for _, tag := range stored {
+		if _, ok := invs[tag]; ok {
+			continue
+		}
+		cache, err := i.tagCacheFunc(tag)
+		if err != nil {
+			return err
+		}
+		invs[tag] = mosaic.NewImageInventory(cache)
+	}
+	removed, err := mosaic.PruneInventories(invs, TagQuota, TotalQuota, Eviction)
+	for tag, keys := range removed {
+		log.Printf("Pruned %d thumbs from %s\n", len(keys), tag)
+	}
+	return err
+}
+
+// inventory returns the images of a tag, if it's been added.
+func (i *thumbInventory) inventory(tag string) (*mosaic.ImageInventory, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	inv, ok := i.images[tag]
+	return inv, ok
+}
+
+func (i *thumbInventory) PopulatePalette(tag string, p *mosaic.ImagePalette, progress mosaic.ProgressFunc) error {
+	inventory, ok := i.inventory(tag)
 	if !ok {
 		return nil
 	}
-	return inventory.PopulatePalette(p)
+	return inventory.PopulatePaletteProgress(p, progress)
 
 }
 
+// Credits attributes the thumbs of a tag that were used from the palette.
+func (i *thumbInventory) Credits(tag string, p *mosaic.ImagePalette) ([]mosaic.Credit, error) {
+	inventory, ok := i.inventory(tag)
+	if !ok {
+		return nil, nil
+	}
+	return inventory.Credits(p)
+}
+
+// RecordUse records that the thumbs of a tag used from the palette were
+// used, for EvictLeastRecentlyUsed.
+func (i *thumbInventory) RecordUse(tag string, p *mosaic.ImagePalette) error {
+	inventory, ok := i.inventory(tag)
+	if !ok {
+		return nil
+	}
+	return inventory.RecordUse(p)
+}
+
 func (i *thumbInventory) Contents() map[string]int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	res := make(map[string]int)
 	for tag, inv := range i.images {
 		res[tag] = inv.Size()
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/instagram"
+	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
+)
+
+func Test_mosaicInventory_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i, err := newMosaicInventory(nil, dir, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := mosaicParams{Units: 10, UnitSize: 20}
+	done, err := i.Create("cat", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetStatus(done.ID, MosaicStatusCreated); err != nil {
+		t.Fatal(err)
+	}
+	working, err := i.Create("dog", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetStatus(working.ID, MosaicStatusWorking); err != nil {
+		t.Fatal(err)
+	}
+	if done.ID == working.ID {
+		t.Fatalf("ids collide: %s", done.ID)
+	}
+
+	i, err = newMosaicInventory(nil, dir, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := i.List()
+	if got, want := len(list), 2; got != want {
+		t.Fatalf("got %d mosaics, want %d", got, want)
+	}
+	if got, want := list[0].ID, done.ID; got != want {
+		t.Errorf("first mosaic got %s, want %s", got, want)
+	}
+	if got, want := list[0].Status, MosaicStatusCreated; got != want {
+		t.Errorf("status got %s, want %s", got, want)
+	}
+	if got, want := list[0].Params, params; got != want {
+		t.Errorf("params got %v, want %v", got, want)
+	}
+	unfinished := i.Unfinished()
+	if got, want := len(unfinished), 1; got != want {
+		t.Fatalf("got %d unfinished mosaics, want %d", got, want)
+	}
+	if got, want := unfinished[0].ID, working.ID; got != want {
+		t.Errorf("unfinished mosaic got %s, want %s", got, want)
+	}
+	if m, _ := i.Get("missing"); m != nil {
+		t.Errorf("got missing mosaic %v", m)
+	}
+}
+
+func Test_newMosaicID(t *testing.T) {
+	now := time.Now()
+	a, err := newMosaicID(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newMosaicID(now.Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 32 {
+		t.Errorf("id %s has length %d, want 32", a, len(a))
+	}
+	if !(a < b) {
+		t.Errorf("ids don't sort by time: %s, %s", a, b)
+	}
+}
+
+func Test_mosaicInventory_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i, err := newMosaicInventory(nil, dir, filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := i.Create("cat", mosaicParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, stop := i.Watch(m.ID)
+
+	// Unread changes are replaced by the latest.
+	if err := i.SetProgress(m.ID, "compose", 40); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetProgress(m.ID, "compose", 50); err != nil {
+		t.Fatal(err)
+	}
+	c := <-changes
+	if got, want := c.Progress, 50; got != want {
+		t.Errorf("progress got %d, want %d", got, want)
+	}
+
+	if err := i.SetStatus(m.ID, MosaicStatusCreated); err != nil {
+		t.Fatal(err)
+	}
+	c = <-changes
+	if got, want := c.Status, MosaicStatusCreated; got != want {
+		t.Errorf("status got %s, want %s", got, want)
+	}
+	if got, want := c.Progress, 100; got != want {
+		t.Errorf("progress got %d, want %d", got, want)
+	}
+
+	stop()
+	if got := len(i.watchers); got != 0 {
+		t.Errorf("got %d watchers after stop", got)
+	}
+}
+
+func Test_mosaicInventory_Cancel_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosaics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i, err := newMosaicInventory(mosaic.NewFileImageCache(dir), filepath.Join(dir, "records"), filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := i.Create("cat", mosaicParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.StoreUpload(m.ID, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.StoreImage(m.ID, "full.jpg", []byte("full")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.StoreRendition(m.ID, "small.jpg", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled mosaic stays cancelled.
+	if err := i.Cancel(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetStatus(m.ID, MosaicStatusCreated); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Fail(m.ID, "oops"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := i.Get(m.ID)
+	if got.Status != MosaicStatusCancelled || got.Reason != "" {
+		t.Errorf("got status %s reason %q, want cancelled", got.Status, got.Reason)
+	}
+
+	// Only done mosaics created before the time expire.
+	if got := len(i.Expired(m.Created)); got != 0 {
+		t.Errorf("got %d expired, want 0", got)
+	}
+	if got := len(i.Expired(time.Now().Add(time.Second))); got != 1 {
+		t.Errorf("got %d expired, want 1", got)
+	}
+
+	if err := i.Delete(m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := i.Get(m.ID); got != nil {
+		t.Errorf("mosaic should be deleted")
+	}
+	if _, err := i.GetUpload(m.ID); err == nil {
+		t.Errorf("upload should be deleted")
+	}
+	for _, name := range []string{"full.jpg", "small.jpg"} {
+		if _, err := i.OpenImage(m.ID, name); !os.IsNotExist(err) {
+			t.Errorf("%s should be deleted, got %v", name, err)
+		}
+	}
+
+	// A job that's still running can't store an image after the delete.
+	if err := i.StoreImage(m.ID, "full.jpg", []byte("late")); err == nil {
+		t.Errorf("StoreImage after Delete should fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "files", string(m.ID))); !os.IsNotExist(err) {
+		t.Errorf("files should stay deleted, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "records", "*")); len(files) != 0 {
+		t.Errorf("records should be deleted, got %v", files)
+	}
+
+	// Reloading doesn't bring it back.
+	i, err = newMosaicInventory(mosaic.NewFileImageCache(dir), filepath.Join(dir, "records"), filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := i.Size(); got != 0 {
+		t.Errorf("got %d mosaics after reload, want 0", got)
+	}
+	if err := i.Delete(m.ID); err != nil {
+		t.Errorf("deleting a missing mosaic got %s", err)
+	}
+}
+
+func Test_thumbInventory_Prune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(q mosaic.Quota) { TotalQuota = q }(TotalQuota)
+	defer func(e mosaic.EvictionPolicy) { Eviction = e }(Eviction)
+	TotalQuota = mosaic.Quota{MaxEntries: 4}
+	Eviction = mosaic.EvictOldest
+
+	cache := func(tag string) mosaic.ImageCache {
+		return mosaic.NewFileImageCache(filepath.Join(dir, tag))
+	}
+	// The dog thumbs were stored before a restart, and are the oldest.
+	then := time.Now().Add(-time.Hour)
+	for _, tag := range []string{"dog", "cat"} {
+		if err := os.MkdirAll(filepath.Join(dir, tag), 0755); err != nil {
+			t.Fatal(err)
+		}
+		c := cache(tag)
+		for _, id := range []string{"a", "b", "c"} {
+			key := c.Key(id)
+			if err := c.Put(key, image.NewRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+				t.Fatal(err)
+			}
+			if tag == "dog" {
+				if err := os.Chtimes(filepath.Join(dir, tag, string(key)+".jpg"), then, then); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	i := &thumbInventory{
+		tagCacheFunc: func(tag string) (mosaic.ImageCache, error) {
+			return cache(tag), nil
+		},
+		tags: func() ([]string, error) {
+			return []string{"cat", "dog"}, nil
+		},
+		images: map[string]*mosaic.ImageInventory{
+			"cat": mosaic.NewImageInventory(cache("cat")),
+		},
+		states: make(map[string]chan bool),
+	}
+	if err := i.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cache("cat").Size(), 3; got != want {
+		t.Errorf("cat has %d thumbs, want %d", got, want)
+	}
+	if got, want := cache("dog").Size(), 1; got != want {
+		t.Errorf("dog has %d thumbs, want %d", got, want)
+	}
+	if _, ok := i.inventory("dog"); ok {
+		t.Errorf("Prune added dog to the inventory")
+	}
+}
+
+func TestLocationTag(t *testing.T) {
+	for _, test := range []struct {
+		q    instagram.LocationQuery
+		want string
+	}{
+		{instagram.LocationQuery{Lat: "37.7", Lng: "-122.4"}, "near-37.7,-122.4"},
+		{instagram.LocationQuery{Lat: "37.7", Lng: "-122.4", Distance: 500}, "near-37.7,-122.4-500m"},
+		{instagram.LocationQuery{Lat: "37.7", Lng: "-122.4", MinTime: time.Unix(1430000000, 0)}, "near-37.7,-122.4-from1430000000"},
+		{instagram.LocationQuery{Lat: "37.7", Lng: "-122.4", Distance: 500, MinTime: time.Unix(1430000000, 0), MaxTime: time.Unix(1430086400, 0)}, "near-37.7,-122.4-500m-from1430000000-to1430086400"},
+	} {
+		if got := LocationTag(test.q); got != test.want {
+			t.Errorf("LocationTag(%+v) got %s, want %s", test.q, got, test.want)
+		}
+	}
+}
+
+func Test_parseLocationTag(t *testing.T) {
+	for _, q := range []instagram.LocationQuery{
+		{Lat: "37.7", Lng: "-122.4"},
+		{Lat: "-33.9", Lng: "151.2", Distance: 500},
+		{Lat: "37.7", Lng: "-122.4", Distance: 500, MinTime: time.Unix(1430000000, 0), MaxTime: time.Unix(1430086400, 0)},
+		{Lat: "37.7", Lng: "-122.4", MaxTime: time.Unix(1430086400, 0)},
+	} {
+		tag := LocationTag(q)
+		got, ok := parseLocationTag(tag)
+		if !ok || LocationTag(got) != tag || got.Lat != q.Lat || got.Lng != q.Lng {
+			t.Errorf("parseLocationTag(%s) got %+v, %t", tag, got, ok)
+		}
+	}
+	for _, tag := range []string{"cat", "near", "near-north,south", "near-1,2-0m", "nearby-1,2"} {
+		if q, ok := parseLocationTag(tag); ok {
+			t.Errorf("parseLocationTag(%s) got %+v, want not a location", tag, q)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Crop modes.
+const (
+	// CropSquare crops the input to a square, units by units.
+	CropSquare = "square"
+	// CropFit keeps the shape of the input, with units across its longer
+	// side.
+	CropFit = "fit"
+)
+
+// Output formats.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+var (
+	// MaxUnits is the most units a request may ask for.
+	MaxUnits = 100
+	// MaxUnitSize is the largest unit size a request may ask for.
+	MaxUnitSize = 300
+	// MaxPaletteSize is the largest palette a request may ask for.
+	MaxPaletteSize = 1024
+	// MaxOutputPixels is the largest mosaic a request may ask for, before
+	// it's shrunk. The mosaic is composed in memory at 4 bytes per pixel.
+	MaxOutputPixels = 8000 * 8000
+)
+
+// mosaicParams are the settings a mosaic is generated with.
+type mosaicParams struct {
+	Units       int     `json:"units"`
+	UnitSize    int     `json:"unit_size"`
+	Shrink      float64 `json:"shrink"`
+	PaletteSize int     `json:"palette_size"`
+	Solid       bool    `json:"solid"`
+	Crop        string  `json:"crop"`
+	Format      string  `json:"format"`
+	// SourceURL is where the image was downloaded from, if it wasn't
+	// uploaded.
+	SourceURL string `json:"src_url,omitempty"`
+	// CallbackURL is where the mosaic is posted when it's created or fails.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// defaultMosaicParams are the server's settings, used for anything a request
+// doesn't specify.
+func defaultMosaicParams() mosaicParams {
+	return mosaicParams{
+		Units:       Units,
+		UnitSize:    UnitSize,
+		Shrink:      1,
+		PaletteSize: PaletteSize,
+		Crop:        CropSquare,
+		Format:      FormatJPEG,
+	}
+}
+
+// withDefaults fills in settings that records made before they existed don't
+// have.
+func (p mosaicParams) withDefaults() mosaicParams {
+	if p.Shrink == 0 {
+		p.Shrink = 1
+	}
+	if p.PaletteSize == 0 {
+		p.PaletteSize = PaletteSize
+	}
+	if p.Crop == "" {
+		p.Crop = CropSquare
+	}
+	if p.Format == "" {
+		p.Format = FormatJPEG
+	}
+	return p
+}
+
+// mosaicParamsFromRequest reads the mosaic params of a request, validated
+// against the server's limits.
+func mosaicParamsFromRequest(r *http.Request) (mosaicParams, error) {
+	p := defaultMosaicParams()
+	for _, v := range []struct {
+		name string
+		ptr  *int
+		max  int
+	}{
+		{"units", &p.Units, MaxUnits},
+		{"unitSize", &p.UnitSize, MaxUnitSize},
+		{"paletteSize", &p.PaletteSize, MaxPaletteSize},
+	} {
+		s := r.FormValue(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > v.max {
+			return p, errInvalidParam("invalid '%s' param, must be 1-%d", v.name, v.max)
+		}
+		*v.ptr = n
+	}
+	// A square mosaic is units by units, and a fit mosaic has units across
+	// its longer side, so neither is larger than this.
+	if side := p.Units * p.UnitSize; side*side > MaxOutputPixels {
+		return p, errInvalidParam("invalid 'units' and 'unitSize' params, the mosaic would be %dx%d, more than %d pixels", side, side, MaxOutputPixels)
+	}
+	if s := r.FormValue("shrink"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return p, errInvalidParam("invalid 'shrink' param, must be greater than 0 and at most 1")
+		}
+		p.Shrink = f
+	}
+	if s := r.FormValue("solid"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return p, errInvalidParam("invalid 'solid' param")
+		}
+		p.Solid = b
+	}
+	switch s := r.FormValue("crop"); s {
+	case "":
+	case CropSquare, CropFit:
+		p.Crop = s
+	default:
+		return p, errInvalidParam("invalid 'crop' param, must be %s or %s", CropSquare, CropFit)
+	}
+	switch s := r.FormValue("format"); s {
+	case "":
+	case FormatJPEG, FormatPNG:
+		p.Format = s
+	default:
+		return p, errInvalidParam("invalid 'format' param, must be %s or %s", FormatJPEG, FormatPNG)
+	}
+	return p, nil
+}
+
+// requestTag reads the request's tag, if it has one. A tag names the dir its
+// thumbs are stored in, so it must be a printable name without separators.
+func requestTag(r *http.Request) (string, error) {
+	tag := r.FormValue("tag")
+	if tag != "" && !validTag(tag) {
+		return "", errInvalidParam("invalid 'tag' param, must be printable without '/', '\\' or '..'")
+	}
+	return tag, nil
+}
+
+// validTag returns true if the tag can name a dir within the thumbs dir.
+func validTag(tag string) bool {
+	if tag == "" || tag == "." || strings.Contains(tag, "..") || strings.ContainsAny(tag, `/\`) {
+		return false
+	}
+	if !utf8.ValidString(tag) {
+		return false
+	}
+	for _, r := range tag {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
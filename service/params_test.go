@@ -0,0 +1,100 @@
+package service
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_mosaicParamsFromRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/mosaics?tag=cat", nil)
+	p, err := mosaicParamsFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p, defaultMosaicParams(); got != want {
+		t.Errorf("defaults got %v, want %v", got, want)
+	}
+
+	r = httptest.NewRequest("POST", "/mosaics?units=20&unitSize=50&shrink=0.5&paletteSize=64&solid=true&crop=fit&format=png", nil)
+	p, err = mosaicParamsFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mosaicParams{
+		Units:       20,
+		UnitSize:    50,
+		Shrink:      0.5,
+		PaletteSize: 64,
+		Solid:       true,
+		Crop:        CropFit,
+		Format:      FormatPNG,
+	}
+	if p != want {
+		t.Errorf("got %v, want %v", p, want)
+	}
+
+	for _, q := range []string{
+		"units=0",
+		"units=1000",
+		"units=100&unitSize=300",
+		"unitSize=x",
+		"paletteSize=100000",
+		"shrink=0",
+		"shrink=2",
+		"solid=maybe",
+		"crop=circle",
+		"format=gif",
+	} {
+		r := httptest.NewRequest("POST", "/mosaics?"+q, nil)
+		_, err := mosaicParamsFromRequest(r)
+		if err == nil {
+			t.Errorf("%s should be invalid", q)
+			continue
+		}
+		name := strings.SplitN(q, "=", 2)[0]
+		if !strings.Contains(err.Error(), "'"+name+"'") {
+			t.Errorf("%s got error %q", q, err)
+		}
+	}
+
+	// The mosaic may be as large as MaxOutputPixels.
+	r = httptest.NewRequest("POST", "/mosaics?units=100&unitSize=80", nil)
+	if _, err := mosaicParamsFromRequest(r); err != nil {
+		t.Errorf("8000x8000 got error %s", err)
+	}
+}
+
+func Test_requestTag(t *testing.T) {
+	for _, test := range []struct {
+		tag   string
+		valid bool
+	}{
+		{"", true},
+		{"cat", true},
+		{"near-37.7,-122.4-500m", true},
+		{"café", true},
+		{".", false},
+		{"..", false},
+		{"../mosaics", false},
+		{"a..b", false},
+		{"cat/dog", false},
+		{`cat\dog`, false},
+		{"cat\ndog", false},
+		{"cat\x00", false},
+		{"\xff", false},
+	} {
+		r := httptest.NewRequest("POST", "/inventory?tag="+url.QueryEscape(test.tag), nil)
+		tag, err := requestTag(r)
+		if test.valid {
+			if err != nil || tag != test.tag {
+				t.Errorf("%q got %q, %v", test.tag, tag, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "'tag'") {
+			t.Errorf("%q got error %v, want invalid 'tag'", test.tag, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errQueueFull is returned when there's no room for another job.
+var errQueueFull = errors.New("mosaic queue is full")
+
+// jobQueue runs mosaic jobs in order with a fixed number of workers, so that
+// a burst of uploads can't generate an unbounded number of mosaics at once.
+type jobQueue struct {
+	depth int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []mosaicID
+	running map[mosaicID]context.CancelFunc
+}
+
+// newJobQueue starts workers that call run for each job. The context is
+// cancelled if the job is. At most depth jobs may wait.
+func newJobQueue(workers, depth int, run func(context.Context, mosaicID)) *jobQueue {
+	q := &jobQueue{
+		depth:   depth,
+		running: make(map[mosaicID]context.CancelFunc),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for n := 0; n < workers; n++ {
+		go func() {
+			for {
+				ctx, id := q.pop()
+				run(ctx, id)
+				q.done(id)
+			}
+		}()
+	}
+	return q
+}
+
+// pop waits for the next job and marks it running.
+func (q *jobQueue) pop() (context.Context, mosaicID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 {
+		q.cond.Wait()
+	}
+	id := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	ctx, cancel := context.WithCancel(context.Background())
+	q.running[id] = cancel
+	return ctx, id
+}
+
+// done releases a job that has finished running.
+func (q *jobQueue) done(id mosaicID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cancel, ok := q.running[id]; ok {
+		cancel()
+		delete(q.running, id)
+	}
+}
+
+// Cancel removes a job that's waiting, or cancels the context of one that's
+// running. It returns false if there's no such job.
+func (q *jobQueue) Cancel(id mosaicID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for n, j := range q.jobs {
+		if j == id {
+			q.jobs = append(q.jobs[:n], q.jobs[n+1:]...)
+			return true
+		}
+	}
+	if cancel, ok := q.running[id]; ok {
+		cancel()
+		return true
+	}
+	return false
+}
+
+// Push adds a job to the end of the queue, or returns errQueueFull.
+func (q *jobQueue) Push(id mosaicID) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) >= q.depth {
+		return errQueueFull
+	}
+	q.jobs = append(q.jobs, id)
+	q.cond.Signal()
+	return nil
+}
+
+// Resume adds a job to the end of the queue even if it's full. It's used for
+// jobs that were accepted before a restart.
+func (q *jobQueue) Resume(id mosaicID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, id)
+	q.cond.Signal()
+}
+
+// Full returns true if Push would fail.
+func (q *jobQueue) Full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs) >= q.depth
+}
+
+// Position returns where a job is in the queue, starting at 1 for the next
+// job to run, or 0 if it isn't waiting.
+func (q *jobQueue) Position(id mosaicID) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for n, j := range q.jobs {
+		if j == id {
+			return n + 1
+		}
+	}
+	return 0
+}
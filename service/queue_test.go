@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_jobQueue(t *testing.T) {
+	release := make(chan bool)
+	ran := make(chan mosaicID)
+	q := newJobQueue(1, 2, func(ctx context.Context, id mosaicID) {
+		ran <- id
+		<-release
+	})
+
+	// The worker takes the first job, leaving room for two more.
+	for _, id := range []mosaicID{"a", "b", "c"} {
+		if err := q.Push(id); err != nil {
+			t.Fatalf("Push(%s) got %s", id, err)
+		}
+		if id == "a" {
+			if got := <-ran; got != "a" {
+				t.Fatalf("ran %s, want a", got)
+			}
+		}
+	}
+	if !q.Full() {
+		t.Errorf("queue should be full")
+	}
+	if err := q.Push("d"); err != errQueueFull {
+		t.Errorf("Push when full got %v, want errQueueFull", err)
+	}
+	q.Resume("d")
+
+	for id, want := range map[mosaicID]int{"a": 0, "b": 1, "c": 2, "d": 3} {
+		if got := q.Position(id); got != want {
+			t.Errorf("Position(%s) got %d, want %d", id, got, want)
+		}
+	}
+
+	for _, want := range []mosaicID{"b", "c", "d"} {
+		release <- true
+		select {
+		case got := <-ran:
+			if got != want {
+				t.Errorf("ran %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	release <- true
+	if q.Full() {
+		t.Errorf("queue should not be full")
+	}
+}
+
+func Test_jobQueue_Cancel(t *testing.T) {
+	started := make(chan mosaicID)
+	stopped := make(chan error)
+	q := newJobQueue(1, 2, func(ctx context.Context, id mosaicID) {
+		started <- id
+		<-ctx.Done()
+		stopped <- ctx.Err()
+	})
+	if err := q.Push("a"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := q.Push("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiting job is removed.
+	if !q.Cancel("b") {
+		t.Errorf("Cancel(b) should find the job")
+	}
+	if got := q.Position("c"); got != 1 {
+		t.Errorf("Position(c) got %d, want 1", got)
+	}
+
+	// A running job is cancelled.
+	if !q.Cancel("a") {
+		t.Errorf("Cancel(a) should find the job")
+	}
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("a stopped with %v, want context.Canceled", err)
+	}
+	if got := <-started; got != "c" {
+		t.Errorf("started %s, want c", got)
+	}
+	if q.Cancel("a") || q.Cancel("b") || q.Cancel("x") {
+		t.Errorf("Cancel should not find finished or unknown jobs")
+	}
+	q.Cancel("c")
+	<-stopped
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/mosaic"
+)
+
+// Rendition sizes.
+const (
+	// SizeThumbnail fits the mosaic within ThumbnailSize.
+	SizeThumbnail = "thumbnail"
+	// SizePreview fits the mosaic within PreviewSize.
+	SizePreview = "preview"
+	// SizeFull is the mosaic as it was created.
+	SizeFull = "full"
+)
+
+// Fit modes.
+const (
+	// FitContain scales the image to fit within the width and height.
+	FitContain = "contain"
+	// FitCover scales the image to fill the width and height, cropping
+	// whatever is outside them from the center.
+	FitCover = "cover"
+)
+
+var (
+	// ThumbnailSize is the longest side of a thumbnail rendition.
+	ThumbnailSize = 200
+	// PreviewSize is the longest side of a preview rendition.
+	PreviewSize = 1024
+	// MaxRenditions is how many renditions of each mosaic are kept. Others
+	// are rendered for each request.
+	MaxRenditions = 10
+	// MaxRenders is how many renditions may be rendered at once. Requests
+	// for more are refused with 503 Service Unavailable.
+	MaxRenders = 4
+	// RenderRetryAfter is how long clients are told to wait when MaxRenders
+	// are being rendered.
+	RenderRetryAfter = 5 * time.Second
+)
+
+// renders counts the renditions being rendered.
+var renders struct {
+	sync.Mutex
+	n int
+}
+
+// startRender reserves one of MaxRenders, returning false if they're all in
+// use. Call finishRender when it's done.
+func startRender() bool {
+	renders.Lock()
+	defer renders.Unlock()
+	if renders.n >= MaxRenders {
+		return false
+	}
+	renders.n++
+	return true
+}
+
+func finishRender() {
+	renders.Lock()
+	defer renders.Unlock()
+	renders.n--
+}
+
+// rendition is a part of a mosaic image at a size.
+type rendition struct {
+	// Region is the part of the image to use, or empty for all of it.
+	Region image.Rectangle
+	// Width and Height are the largest size to render, or 0 to follow the
+	// other side.
+	Width, Height int
+	Fit           string
+}
+
+// renditionFromRequest reads the rendition params of a request.
+func renditionFromRequest(r *http.Request) (rendition, error) {
+	rend := rendition{Fit: FitContain}
+	switch s := r.FormValue("size"); s {
+	case "", SizeFull:
+	case SizeThumbnail:
+		rend.Width, rend.Height = ThumbnailSize, ThumbnailSize
+	case SizePreview:
+		rend.Width, rend.Height = PreviewSize, PreviewSize
+	default:
+		return rend, errInvalidParam("invalid 'size' param, must be %s, %s or %s", SizeThumbnail, SizePreview, SizeFull)
+	}
+	for name, ptr := range map[string]*int{
+		"width":  &rend.Width,
+		"height": &rend.Height,
+	} {
+		s := r.FormValue(name)
+		if s == "" {
+			continue
+		}
+		if r.FormValue("size") != "" {
+			return rend, errInvalidParam("use 'size' or '%s', not both", name)
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return rend, errInvalidParam("invalid '%s' param, must be at least 1", name)
+		}
+		*ptr = n
+	}
+	switch s := r.FormValue("fit"); s {
+	case "":
+	case FitContain, FitCover:
+		rend.Fit = s
+	default:
+		return rend, errInvalidParam("invalid 'fit' param, must be %s or %s", FitContain, FitCover)
+	}
+	if s := r.FormValue("region"); s != "" {
+		var v [4]int
+		parts := strings.Split(s, ",")
+		if len(parts) != len(v) {
+			return rend, errInvalidParam("invalid 'region' param, must be x,y,width,height")
+		}
+		for i, p := range parts {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 || (i >= 2 && n < 1) {
+				return rend, errInvalidParam("invalid 'region' param, must be x,y,width,height")
+			}
+			v[i] = n
+		}
+		rend.Region = image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	}
+	return rend, nil
+}
+
+// IsFull returns true if the rendition is the whole image as it was created.
+func (r rendition) IsFull() bool {
+	return r.Region.Empty() && r.Width == 0 && r.Height == 0
+}
+
+// Name identifies the rendition among a mosaic's renditions.
+func (r rendition) Name() string {
+	name := fmt.Sprintf("%dx%d-%s", r.Width, r.Height, r.Fit)
+	if !r.Region.Empty() {
+		name += fmt.Sprintf("-%d,%d,%d,%d", r.Region.Min.X, r.Region.Min.Y, r.Region.Dx(), r.Region.Dy())
+	}
+	return name
+}
+
+// Render makes the rendition from the full image. Images are never scaled
+// up.
+func (r rendition) Render(in image.Image) (image.Image, error) {
+	if !r.Region.Empty() {
+		b := in.Bounds()
+		if !r.Region.Add(b.Min).In(b) {
+			return nil, errInvalidParam("'region' is outside the %dx%d image", b.Dx(), b.Dy())
+		}
+		in = crop(in, r.Region.Add(b.Min))
+	}
+	if r.Width == 0 && r.Height == 0 {
+		return in, nil
+	}
+
+	// Find the scale of each side, following the other if it's not set.
+	size := in.Bounds().Size()
+	sx := float64(r.Width) / float64(size.X)
+	sy := float64(r.Height) / float64(size.Y)
+	if r.Width == 0 {
+		sx = sy
+	}
+	if r.Height == 0 {
+		sy = sx
+	}
+	scale := math.Min(sx, sy)
+	if r.Fit == FitCover {
+		scale = math.Max(sx, sy)
+	}
+	out := in
+	if scale < 1 {
+		x := int(math.Max(math.Round(float64(size.X)*scale), 1))
+		y := int(math.Max(math.Round(float64(size.Y)*scale), 1))
+		out = mosaic.Resize(in, x, y)
+	}
+
+	// Cover crops the scaled image to the width and height.
+	if r.Fit == FitCover {
+		b := out.Bounds()
+		w, h := b.Dx(), b.Dy()
+		if r.Width > 0 && r.Width < w {
+			w = r.Width
+		}
+		if r.Height > 0 && r.Height < h {
+			h = r.Height
+		}
+		min := b.Min.Add(image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2))
+		out = crop(out, image.Rectangle{min, min.Add(image.Pt(w, h))})
+	}
+	return out, nil
+}
+
+// File is the name that the rendition is stored as, encoded in format.
+func (r rendition) File(format string) string {
+	name := SizeFull
+	if !r.IsFull() {
+		name = r.Name()
+	}
+	if format == FormatPNG {
+		return name + ".png"
+	}
+	return name + ".jpg"
+}
+
+// encodeImage encodes an image in format.
+func encodeImage(m image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == FormatPNG {
+		err = png.Encode(&buf, m)
+	} else {
+		err = jpeg.Encode(&buf, m, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contentType is the media type of an image encoded in format.
+func contentType(format string) string {
+	if format == FormatPNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// crop copies part of an image.
+func crop(in image.Image, r image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(out, out.Bounds(), in, r.Min, draw.Src)
+	return out
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"image"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_renditionFromRequest(t *testing.T) {
+	for q, want := range map[string]rendition{
+		"":                    {Fit: FitContain},
+		"size=full":           {Fit: FitContain},
+		"size=thumbnail":      {Width: ThumbnailSize, Height: ThumbnailSize, Fit: FitContain},
+		"width=300&fit=cover": {Width: 300, Fit: FitCover},
+		"region=10,20,30,40":  {Region: image.Rect(10, 20, 40, 60), Fit: FitContain},
+	} {
+		r := httptest.NewRequest("GET", "/mosaics/img?"+q, nil)
+		got, err := renditionFromRequest(r)
+		if err != nil {
+			t.Errorf("%s got error %s", q, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s got %+v, want %+v", q, got, want)
+		}
+	}
+
+	for _, q := range []string{
+		"size=huge",
+		"width=0",
+		"height=x",
+		"size=preview&width=10",
+		"fit=stretch",
+		"region=1,2,3",
+		"region=0,0,0,10",
+		"region=-1,0,10,10",
+	} {
+		r := httptest.NewRequest("GET", "/mosaics/img?"+q, nil)
+		_, err := renditionFromRequest(r)
+		if err == nil {
+			t.Errorf("%s should be invalid", q)
+			continue
+		}
+		name := strings.SplitN(q, "=", 2)[0]
+		if !strings.Contains(err.Error(), "'"+name+"'") {
+			t.Errorf("%s got error %q", q, err)
+		}
+	}
+}
+
+func Test_rendition_Render(t *testing.T) {
+	in := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	for _, test := range []struct {
+		r    rendition
+		want image.Point
+	}{
+		{rendition{Fit: FitContain}, image.Pt(600, 400)},
+		{rendition{Width: 300, Height: 300, Fit: FitContain}, image.Pt(300, 200)},
+		{rendition{Width: 300, Height: 300, Fit: FitCover}, image.Pt(300, 300)},
+		{rendition{Height: 100, Fit: FitContain}, image.Pt(150, 100)},
+		{rendition{Width: 1000, Height: 1000, Fit: FitContain}, image.Pt(600, 400)},
+		{rendition{Width: 1000, Height: 100, Fit: FitCover}, image.Pt(600, 100)},
+		{rendition{Region: image.Rect(100, 100, 300, 200), Fit: FitContain}, image.Pt(200, 100)},
+		{rendition{Region: image.Rect(100, 100, 300, 200), Width: 50, Fit: FitContain}, image.Pt(50, 25)},
+	} {
+		out, err := test.r.Render(in)
+		if err != nil {
+			t.Errorf("%s got error %s", test.r.Name(), err)
+			continue
+		}
+		if got := out.Bounds().Size(); got != test.want {
+			t.Errorf("%s got %v, want %v", test.r.Name(), got, test.want)
+		}
+	}
+
+	r := rendition{Region: image.Rect(500, 0, 700, 100), Fit: FitContain}
+	if _, err := r.Render(in); err == nil {
+		t.Errorf("region outside the image should be invalid")
+	}
+}
@@ -0,0 +1,86 @@
+package source
+
+import (
+	"context"
+	"image"
+	// To decode jpg and png
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirSource implements Source for the images in a local folder.
+type dirSource struct {
+	dir string
+	err error
+}
+
+// NewDirSource gives you a Source of the jpg and png images in a folder.
+func NewDirSource(dir string) Source {
+	return &dirSource{dir: dir}
+}
+
+func (s *dirSource) Items(ctx context.Context) <-chan Item {
+	ch := make(chan Item)
+	go func() {
+		defer close(ch)
+		names, err := s.files()
+		if err != nil {
+			s.err = err
+			return
+		}
+		for _, name := range names {
+			if !Send(ctx, ch, fileItem(name)) {
+				s.err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *dirSource) Err() error {
+	return s.err
+}
+
+// files lists the images in the folder, sorted by name.
+func (s *dirSource) files() ([]string, error) {
+	dir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".jpg", ".jpeg", ".png":
+			if !info.IsDir() {
+				names = append(names, filepath.Join(dir, info.Name()))
+			}
+		}
+	}
+	return names, nil
+}
+
+// fileItem is an image file, identified by its absolute path.
+type fileItem string
+
+func (f fileItem) ID() string {
+	return "file://" + string(f)
+}
+
+func (f fileItem) Image(ctx context.Context) (image.Image, error) {
+	fi, err := os.Open(string(f))
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	m, _, err := image.Decode(fi)
+	return m, err
+}
@@ -0,0 +1,59 @@
+package source
+
+import (
+	"context"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.jpg", "a.jpg"} {
+		fo, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		jpeg.Encode(fo, image.NewRGBA(image.Rect(0, 0, 10, 10)), nil)
+		fo.Close()
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0644)
+
+	s := NewDirSource(dir)
+	var items []Item
+	for item := range s.Items(context.Background()) {
+		items = append(items, item)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err got %s", err)
+	}
+	if got, want := len(items), 2; got != want {
+		t.Fatalf("got %d items, want %d", got, want)
+	}
+	if got, want := items[0].ID(), "file://"+filepath.Join(dir, "a.jpg"); got != want {
+		t.Errorf("ID got %s, want %s", got, want)
+	}
+	m, err := items[0].Image(context.Background())
+	if err != nil {
+		t.Fatalf("Image got error %s", err)
+	}
+	if got, want := m.Bounds().Dx(), 10; got != want {
+		t.Errorf("Dx got %d, want %d", got, want)
+	}
+}
+
+func TestDirSource_missing(t *testing.T) {
+	s := NewDirSource("/does/not/exist")
+	for range s.Items(context.Background()) {
+	}
+	if s.Err() == nil {
+		t.Errorf("Err got nil, want error")
+	}
+}
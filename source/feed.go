@@ -0,0 +1,258 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Feed formats.
+const (
+	// FormatJSON reads image urls from a JSON document with Selector.
+	FormatJSON = "json"
+	// FormatRSS reads image enclosures from an RSS or Atom feed.
+	FormatRSS = "rss"
+)
+
+// FeedConfig describes an HTTP feed of images.
+type FeedConfig struct {
+	// URL is the first page of the feed.
+	URL string
+	// Format is FormatJSON or FormatRSS. If empty, it's detected from each
+	// response.
+	Format string
+	// Selector finds image urls in a JSON feed, such as
+	// "$.items[*].image.url". See SelectJSON.
+	Selector string
+	// NextSelector finds the url of the next page in a JSON feed, such as
+	// "$.next". RSS and Atom feeds use <link rel="next">, and any feed may
+	// use a Link header.
+	NextSelector string
+	// MaxPages stops the feed after this many pages. Zero is unlimited.
+	MaxPages int
+	// Client is the HTTP client to use. Defaults to one with a 30 second
+	// timeout.
+	Client *http.Client
+}
+
+// feedSource implements Source for a paginated HTTP feed.
+type feedSource struct {
+	FeedConfig
+	err error
+}
+
+// NewFeedSource gives you a Source of the images listed in an HTTP feed.
+func NewFeedSource(cfg FeedConfig) Source {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &feedSource{FeedConfig: cfg}
+}
+
+func (s *feedSource) Items(ctx context.Context) <-chan Item {
+	ch := make(chan Item)
+	go func() {
+		defer close(ch)
+		seen := make(map[string]bool)
+		next := s.URL
+		for page := 0; next != "" && !seen[next]; page++ {
+			if s.MaxPages > 0 && page >= s.MaxPages {
+				return
+			}
+			seen[next] = true
+			urls, nextURL, err := s.page(ctx, next)
+			if err != nil {
+				s.err = err
+				return
+			}
+			for _, u := range urls {
+				if !Send(ctx, ch, &httpItem{url: u, client: s.Client}) {
+					s.err = ctx.Err()
+					return
+				}
+			}
+			next = nextURL
+		}
+	}()
+	return ch
+}
+
+func (s *feedSource) Err() error {
+	return s.err
+}
+
+// page reads one page of the feed, returning absolute image urls and the url
+// of the next page.
+func (s *feedSource) page(ctx context.Context, pageURL string) ([]string, string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := get(ctx, s.Client, pageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var urls []string
+	var next string
+	switch s.format(res, body) {
+	case FormatJSON:
+		urls, next, err = s.parseJSON(body)
+	case FormatRSS:
+		urls, next, err = parseXMLFeed(body)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading feed %s: %s", pageURL, err)
+	}
+	if next == "" {
+		next = linkHeaderNext(res.Header.Get("Link"))
+	}
+
+	for i, u := range urls {
+		urls[i] = resolve(base, u)
+	}
+	if next != "" {
+		next = resolve(base, next)
+	}
+	return urls, next, nil
+}
+
+// format returns the configured format, or detects it from the response.
+func (s *feedSource) format(res *http.Response, body []byte) string {
+	if s.Format != "" {
+		return s.Format
+	}
+	if strings.Contains(res.Header.Get("Content-Type"), "json") {
+		return FormatJSON
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return FormatJSON
+	}
+	return FormatRSS
+}
+
+func (s *feedSource) parseJSON(body []byte) ([]string, string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, "", err
+	}
+	if s.Selector == "" {
+		return nil, "", fmt.Errorf("a selector is required for JSON feeds")
+	}
+	vals, err := SelectJSON(doc, s.Selector)
+	if err != nil {
+		return nil, "", err
+	}
+	urls := stringValues(vals)
+	var next string
+	if s.NextSelector != "" {
+		vals, err := SelectJSON(doc, s.NextSelector)
+		if err != nil {
+			return nil, "", err
+		}
+		if n := stringValues(vals); len(n) > 0 {
+			next = n[0]
+		}
+	}
+	return urls, next, nil
+}
+
+// stringValues returns the non-empty strings in vals.
+func stringValues(vals []interface{}) []string {
+	out := []string{}
+	for _, v := range vals {
+		if s, ok := v.(string); ok && s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// parseXMLFeed reads image urls and the next page url from an RSS or Atom
+// feed. Images are RSS enclosures, Media RSS content and thumbnails, and Atom
+// enclosure links.
+func parseXMLFeed(body []byte) ([]string, string, error) {
+	urls := []string{}
+	var next string
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		attrs := make(map[string]string)
+		for _, a := range el.Attr {
+			attrs[a.Name.Local] = a.Value
+		}
+		isImage := attrs["type"] == "" || strings.HasPrefix(attrs["type"], "image/")
+		switch el.Name.Local {
+		case "enclosure":
+			if isImage && attrs["url"] != "" {
+				urls = append(urls, attrs["url"])
+			}
+		case "content", "thumbnail":
+			// Media RSS, <media:content url="..." medium="image">.
+			if attrs["url"] != "" && isImage && (attrs["medium"] == "" || attrs["medium"] == "image") {
+				urls = append(urls, attrs["url"])
+			}
+		case "link":
+			switch attrs["rel"] {
+			case "enclosure":
+				if isImage && attrs["href"] != "" {
+					urls = append(urls, attrs["href"])
+				}
+			case "next":
+				next = attrs["href"]
+			}
+		}
+	}
+	return urls, next, nil
+}
+
+// linkHeaderNext returns the rel="next" url from a Link header.
+func linkHeaderNext(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		for _, p := range parts[1:] {
+			p = strings.Replace(strings.TrimSpace(p), `"`, "", -1)
+			if p == "rel=next" {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// resolve makes a url absolute relative to base.
+func resolve(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
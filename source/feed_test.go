@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func newFeedServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("page") {
+		case "":
+			fmt.Fprint(w, `{"items": [{"image": {"url": "/img/1.png"}}, {"image": {"url": "/img/2.png"}}], "next": "/feed.json?page=2"}`)
+		case "2":
+			fmt.Fprint(w, `{"items": [{"image": {"url": "/img/3.png"}}, {"title": "no image"}], "next": "/feed.json?page=2"}`)
+		}
+	})
+	mux.HandleFunc("/feed.rss", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+  <atom:link rel="next" href="/feed.atom"/>
+  <item><enclosure url="/img/1.png" type="image/png" length="1"/></item>
+  <item><enclosure url="/talk.mp3" type="audio/mpeg" length="1"/></item>
+  <item><media:content url="/img/2.png" medium="image"/></item>
+</channel>
+</rss>`)
+	})
+	mux.HandleFunc("/feed.atom", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <entry><link rel="enclosure" type="image/png" href="/img/3.png"/></entry>
+</feed>`)
+	})
+	mux.HandleFunc("/img/", func(w http.ResponseWriter, r *http.Request) {
+		png.Encode(w, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	})
+	return httptest.NewServer(mux)
+}
+
+func feedIDs(t *testing.T, s Source) []string {
+	ids := []string{}
+	for item := range s.Items(context.Background()) {
+		ids = append(ids, item.ID())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err got %s", err)
+	}
+	return ids
+}
+
+func TestFeedSource_json(t *testing.T) {
+	ts := newFeedServer(t)
+	defer ts.Close()
+
+	s := NewFeedSource(FeedConfig{
+		URL:          ts.URL + "/feed.json",
+		Selector:     "$.items[*].image.url",
+		NextSelector: "$.next",
+	})
+	got := feedIDs(t, s)
+	want := []string{ts.URL + "/img/1.png", ts.URL + "/img/2.png", ts.URL + "/img/3.png"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFeedSource_maxPages(t *testing.T) {
+	ts := newFeedServer(t)
+	defer ts.Close()
+
+	s := NewFeedSource(FeedConfig{
+		URL:          ts.URL + "/feed.json",
+		Selector:     "$.items[*].image.url",
+		NextSelector: "$.next",
+		MaxPages:     1,
+	})
+	if got, want := len(feedIDs(t, s)), 2; got != want {
+		t.Errorf("got %d items, want %d", got, want)
+	}
+}
+
+func TestFeedSource_rss(t *testing.T) {
+	ts := newFeedServer(t)
+	defer ts.Close()
+
+	s := NewFeedSource(FeedConfig{URL: ts.URL + "/feed.rss"})
+	got := feedIDs(t, s)
+	want := []string{ts.URL + "/img/1.png", ts.URL + "/img/2.png", ts.URL + "/img/3.png"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFeedSource_image(t *testing.T) {
+	ts := newFeedServer(t)
+	defer ts.Close()
+
+	s := NewFeedSource(FeedConfig{URL: ts.URL + "/feed.atom"})
+	for item := range s.Items(context.Background()) {
+		m, err := item.Image(context.Background())
+		if err != nil {
+			t.Fatalf("Image got error %s", err)
+		}
+		if got, want := m.Bounds().Dx(), 10; got != want {
+			t.Errorf("Dx got %d, want %d", got, want)
+		}
+	}
+}
+
+func TestFeedSource_error(t *testing.T) {
+	ts := newFeedServer(t)
+	defer ts.Close()
+
+	s := NewFeedSource(FeedConfig{URL: ts.URL + "/missing"})
+	for range s.Items(context.Background()) {
+	}
+	if s.Err() == nil {
+		t.Errorf("Err got nil, want error")
+	}
+}
+
+func TestSelectJSON(t *testing.T) {
+	doc := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"url": "a"},
+			map[string]interface{}{"url": "b"},
+		},
+		"next": "n",
+	}
+	tests := []struct {
+		sel  string
+		want []interface{}
+	}{
+		{"$.next", []interface{}{"n"}},
+		{"$.data[*].url", []interface{}{"a", "b"}},
+		{"$.data[1].url", []interface{}{"b"}},
+		{"$['data'][0]['url']", []interface{}{"a"}},
+		{"$.missing.url", nil},
+	}
+	for _, test := range tests {
+		got, err := SelectJSON(doc, test.sel)
+		if err != nil {
+			t.Errorf("%s got error %s", test.sel, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s got %v, want %v", test.sel, got, test.want)
+		}
+	}
+	for _, sel := range []string{"data", "$.", "$[0", "$[x]"} {
+		if _, err := SelectJSON(doc, sel); err == nil {
+			t.Errorf("%s got nil, want error", sel)
+		}
+	}
+}
+
+func TestLinkHeaderNext(t *testing.T) {
+	h := `<https://example.com/p1>; rel="prev", <https://example.com/p3>; rel="next"`
+	if got, want := linkHeaderNext(h), "https://example.com/p3"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
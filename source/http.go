@@ -0,0 +1,53 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+// httpItem is an image at a URL.
+type httpItem struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPItem gives you an Item for the image at a URL.
+func NewHTTPItem(url string, client *http.Client) Item {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpItem{url, client}
+}
+
+func (h *httpItem) ID() string {
+	return h.url
+}
+
+func (h *httpItem) Image(ctx context.Context) (image.Image, error) {
+	res, err := get(ctx, h.client, h.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	m, _, err := image.Decode(res.Body)
+	return m, err
+}
+
+// get requests a URL, returning an error for anything but 200.
+func get(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("Call to %s failed, status %d", url, res.StatusCode)
+	}
+	return res, nil
+}
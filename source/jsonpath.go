@@ -0,0 +1,114 @@
+package source
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SelectJSON finds values in a decoded JSON document with a JSONPath-like
+// selector. A selector is a "$" followed by steps:
+//
+//	.name   a field of an object
+//	[n]     element n of an array
+//	[*]     every element of an array, or every field of an object
+//
+// For example "$.items[*].images.standard.url". Steps that don't match
+// anything produce no values rather than an error.
+func SelectJSON(doc interface{}, selector string) ([]interface{}, error) {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	vals := []interface{}{doc}
+	for _, step := range steps {
+		var next []interface{}
+		for _, v := range vals {
+			next = append(next, step.apply(v)...)
+		}
+		vals = next
+	}
+	return vals, nil
+}
+
+// selectorStep is one step of a selector.
+type selectorStep struct {
+	field    string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func (s selectorStep) apply(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			out := make([]interface{}, 0, len(t))
+			for _, x := range t {
+				out = append(out, x)
+			}
+			return out
+		}
+		if x, ok := t[s.field]; ok && !s.isIndex {
+			return []interface{}{x}
+		}
+	case []interface{}:
+		if s.wildcard {
+			return t
+		}
+		if s.isIndex && s.index >= 0 && s.index < len(t) {
+			return []interface{}{t[s.index]}
+		}
+	}
+	return nil
+}
+
+func parseSelector(selector string) ([]selectorStep, error) {
+	if !strings.HasPrefix(selector, "$") {
+		return nil, fmt.Errorf("selector %q must start with $", selector)
+	}
+	rest := selector[1:]
+	steps := []selectorStep{}
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("selector %q has an empty field", selector)
+			}
+			if name == "*" {
+				steps = append(steps, selectorStep{wildcard: true})
+			} else {
+				steps = append(steps, selectorStep{field: name})
+			}
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("selector %q is missing ]", selector)
+			}
+			inner := strings.Trim(rest[1:end], `'"`)
+			switch {
+			case inner == "*":
+				steps = append(steps, selectorStep{wildcard: true})
+			case inner != "" && inner == rest[1:end]:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("selector %q has a bad index %q", selector, inner)
+				}
+				steps = append(steps, selectorStep{index: n, isIndex: true})
+			default:
+				// ['name'] quoted field.
+				steps = append(steps, selectorStep{field: inner})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("selector %q is invalid at %q", selector, rest)
+		}
+	}
+	return steps, nil
+}
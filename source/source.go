@@ -0,0 +1,67 @@
+// Package source defines where inventory images come from. Any provider of
+// images, such as a photo API, a feed or a local folder, implements Source so
+// that it can populate an inventory.
+package source
+
+import (
+	"context"
+	"image"
+	"time"
+)
+
+// Item is one image available from a Source.
+type Item interface {
+	// ID uniquely and consistently identifies the item, such as its URL.
+	ID() string
+
+	// Image downloads and decodes the image. The download is cancelled if
+	// ctx is done.
+	Image(ctx context.Context) (image.Image, error)
+}
+
+// Attribution credits the creator of an image.
+type Attribution struct {
+	// Author is the creator's name or username.
+	Author string `json:"author,omitempty"`
+	// Username is the creator's account name.
+	Username string `json:"username,omitempty"`
+	// AuthorURL links to the creator's profile.
+	AuthorURL string `json:"author_url,omitempty"`
+	// Caption is the creator's description of the image.
+	Caption string `json:"caption,omitempty"`
+	// Link is the page where the image was published.
+	Link string `json:"link,omitempty"`
+	// Tags are the labels the image was published with.
+	Tags []string `json:"tags,omitempty"`
+	// Created is when the image was published, or the zero time.
+	Created time.Time `json:"created,omitempty"`
+}
+
+// Attributed is implemented by items that know who created them.
+type Attributed interface {
+	Attribution() Attribution
+}
+
+// Source produces items.
+type Source interface {
+	// Items returns a channel that receives items. The channel is closed
+	// when there are no more items, when an error occurs, or when ctx is
+	// done. Cancel ctx to stop producing items.
+	Items(ctx context.Context) <-chan Item
+
+	// Err returns the error that stopped the source, if any. It's only
+	// valid after the channel is closed.
+	Err() error
+}
+
+// Send delivers items to the channel. It returns false if ctx is done first.
+func Send(ctx context.Context, ch chan<- Item, items ...Item) bool {
+	for _, item := range items {
+		select {
+		case ch <- item:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -10,7 +10,15 @@ log() {
 }
 
 mosaicly=$GOPATH/bin/mosaicly
-dir=`mktemp -d -t mosaicly`
+fakeinstagram=$GOPATH/bin/fakeinstagram
+dir=`mktemp -d -t mosaicly.XXXXXX`
+
+# Serve recorded Instagram responses instead of using the network.
+$fakeinstagram -port 9090 -fixtures fixtures/instagram &
+fake_pid=$!
+trap "kill $fake_pid" EXIT
+export INSTAGRAM_API_URL="http://127.0.0.1:9090/v1"
+sleep 1
 log "Using tmp $dir"
 
 log "Fetching..."
@@ -26,5 +34,7 @@ log "Testing output"
 test -f $dir/test.jpg
 
 log "Opening image..."
-open $dir/test.jpg
+if command -v open > /dev/null; then
+  open $dir/test.jpg
+fi
 
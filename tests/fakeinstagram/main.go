@@ -0,0 +1,52 @@
+// Command fakeinstagram runs a fake Instagram API for the integration tests,
+// serving recorded fixtures. Point mosaicly at it with INSTAGRAM_API_URL.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rcarver/golang-challenge-3-mosaic/instagram/instagramtest"
+)
+
+func main() {
+	var (
+		port      = flag.Int("port", 9090, "port to listen on")
+		dir       = flag.String("fixtures", "fixtures/instagram", "dir of recorded fixtures")
+		latency   = flag.Duration("latency", 0, "delay every response by this long")
+		failCode  = flag.Int("fail", 0, "respond with this status code to failing requests")
+		failPath  = flag.String("failPath", "", "fail requests with paths starting with this")
+		failTimes = flag.Int("failTimes", 0, "fail this many requests, 0 for all")
+	)
+	flag.Parse()
+
+	f, err := instagramtest.LoadFixtures(*dir)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures: %s\n", err)
+	}
+	s := instagramtest.NewUnstartedServer(f)
+	s.Listener.Close()
+	s.Listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		log.Fatalf("Failed to listen: %s\n", err)
+	}
+	s.Start()
+	defer s.Close()
+
+	if *latency > 0 {
+		s.SetLatency(*latency)
+	}
+	if *failCode != 0 {
+		s.Fail(instagramtest.Failure{Path: *failPath, Status: *failCode, Times: *failTimes})
+	}
+	log.Printf("Serving %d tags at %s\n", len(f.Tags), s.APIURL())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+}
@@ -10,7 +10,15 @@ log() {
 }
 
 mosaicly=$GOPATH/bin/mosaicly
-dir=`mktemp -d -t mosaicly`
+fakeinstagram=$GOPATH/bin/fakeinstagram
+dir=`mktemp -d -t mosaicly.XXXXXX`
+
+# Serve recorded Instagram responses instead of using the network.
+$fakeinstagram -port 9090 -fixtures fixtures/instagram &
+fake_pid=$!
+trap "kill $fake_pid" EXIT
+export INSTAGRAM_API_URL="http://127.0.0.1:9090/v1"
+sleep 1
 
 port=8081
 endpoint="localhost:$port"
@@ -19,6 +27,7 @@ img="balloon.jpg"
 
 log "Starting server..."
 $mosaicly serve -dir $dir -port $port -num 5 -units 10 &
+trap "kill $fake_pid $!" EXIT
 sleep 1
 
 log "Create a new mosaic..."
@@ -32,20 +41,27 @@ status=$(echo $res | jq -M -r .status)
 # Show the URL
 log "New mosaic: id:$id status:$status at ${url}"
 
-# Wait for the image to be done.
-while [[ "$status" != "created" ]]; do
-  status=$(curl -fs "${endpoint}${url}" | jq -M -r .status)
-  log "Waiting for mosaic..."
-  sleep 1
-done;
+# Wait for the image to be done, following its progress. The stream ends when
+# the mosaic is created or fails.
+log "Waiting for mosaic..."
+status=$(curl -fsN "${endpoint}/mosaics/events?id=${id}" \
+  | sed -n 's/^data: //p' \
+  | while read -r event; do
+      echo $event | jq -M -r '"progress: \(.status) \(.stage // "") \(.progress)%"' 1>&2
+      echo $event | jq -M -r .status
+    done | tail -1)
+if [[ "$status" != "created" ]]; then
+  log "Mosaic $status"
+  exit 1
+fi
 
 log "All mosaics..."
 res=$(curl -fs "${endpoint}/mosaics")
-echo $res | jsonpretty
+echo $res | jq -M .
 
 log "Opening image..."
 curl -fs ${endpoint}${img_url} > ${dir}/${img}
-open ${dir}/${img}
-
-killall mosaicly
+if command -v open > /dev/null; then
+  open ${dir}/${img}
+fi
 